@@ -0,0 +1,238 @@
+package katamari
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/benitogf/katamari/key"
+	"github.com/goccy/go-json"
+)
+
+var errACLDenied = withCode(ErrForbidden, errors.New("katamari: aclError operation not allowed"))
+
+// aclPlaceholder of a rule path, bound to the caller when the rule is evaluated
+var aclPlaceholder = regexp.MustCompile(`\{([a-zA-Z\d_]+)\}`)
+
+// ACLRule grants operations on a path (glob) to roles and users
+//
+// Path: glob of the keys, "{self}" is replaced by the caller user and "{name}" by a string claim of the token,
+// the rule doesn't apply when the value is missing, contains "/" or "*" or isn't a valid key segment
+//
+// Roles: roles granted, "*" grants every caller including the ones without identity
+//
+// Users: users granted
+//
+// Operations: OpRead, OpWrite, OpDelete, OpSubscribe or "*", OpRead also grants OpSubscribe
+type ACLRule struct {
+	Path       string   `json:"path"`
+	Roles      []string `json:"roles,omitempty"`
+	Users      []string `json:"users,omitempty"`
+	Operations []string `json:"operations"`
+}
+
+// acl rules of the server, empty until a rule is defined
+type acl struct {
+	mutex sync.RWMutex
+	rules []ACLRule
+}
+
+// aclSubject caller of a request as seen by the access control lists
+type aclSubject struct {
+	user   string
+	roles  []string
+	claims Claims
+}
+
+// Allow adds an access control rule, once a rule is defined the keys
+// and operations without a matching rule are denied
+func (app *Server) Allow(rule ACLRule) {
+	app.acl.mutex.Lock()
+	defer app.acl.mutex.Unlock()
+	app.acl.rules = append(app.acl.rules, rule)
+}
+
+// LoadACL adds the access control rules of a json file, an array of ACLRule
+func (app *Server) LoadACL(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var rules []ACLRule
+	err = json.Unmarshal(data, &rules)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if rule.Path == "" || len(rule.Operations) == 0 {
+			return errors.New("katamari: aclError rules require a path and operations")
+		}
+	}
+	app.acl.mutex.Lock()
+	defer app.acl.mutex.Unlock()
+	app.acl.rules = append(app.acl.rules, rules...)
+	return nil
+}
+
+func (a *acl) active() bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return len(a.rules) > 0
+}
+
+// aclSubjectOf a context, the "sub" and "roles" claims of the token or a string identity
+func aclSubjectOf(ctx context.Context) aclSubject {
+	claims := TokenClaims(ctx)
+	switch identity := Identity(ctx).(type) {
+	case Claims:
+		claims = identity
+	case string:
+		return aclSubject{user: identity, roles: claims.Roles(), claims: claims}
+	}
+	return aclSubject{user: claims.Subject(), roles: claims.Roles(), claims: claims}
+}
+
+// grants checks the operation and caller of a rule
+func (rule ACLRule) grants(subject aclSubject, operation string) bool {
+	if !slices.Contains(rule.Operations, operation) && !slices.Contains(rule.Operations, "*") &&
+		(operation != OpSubscribe || !slices.Contains(rule.Operations, OpRead)) {
+		return false
+	}
+	if slices.Contains(rule.Roles, "*") {
+		return true
+	}
+	if subject.user != "" && slices.Contains(rule.Users, subject.user) {
+		return true
+	}
+	for _, role := range subject.roles {
+		if slices.Contains(rule.Roles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// bind the placeholders of a rule path to the caller
+func (rule ACLRule) bind(subject aclSubject) (string, bool) {
+	bound := true
+	path := aclPlaceholder.ReplaceAllStringFunc(rule.Path, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		value := subject.user
+		if name != "self" {
+			value, _ = subject.claims[name].(string)
+		}
+		if !key.IsValid(value) || strings.ContainsAny(value, "/*") {
+			bound = false
+		}
+		return value
+	})
+	return path, bound
+}
+
+// allowed checks if any rule grants the operation on the key to the caller
+func (a *acl) allowed(subject aclSubject, operation string, _key string) bool {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	for _, rule := range a.rules {
+		if !rule.grants(subject, operation) {
+			continue
+		}
+		path, bound := rule.bind(subject)
+		if bound && key.Match(path, _key) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkACL of an operation, reads of a list are not denied here since
+// their results are filtered by filterList
+func (app *Server) checkACL(ctx context.Context, operation string, _key string) error {
+	if _key == "" || operation == OpClock || !app.acl.active() {
+		return nil
+	}
+	if operation == OpRead && listKey(_key) {
+		return nil
+	}
+	if !app.acl.allowed(aclSubjectOf(ctx), operation, _key) {
+		return errACLDenied
+	}
+	return nil
+}
+
+// listKey a glob that only matches the last segment, the keys of its items are known
+func listKey(_key string) bool {
+	return strings.HasSuffix(_key, "/*") && strings.Count(_key, "*") == 1
+}
+
+// filterList removes the items of a list read that the caller can't read
+func (app *Server) filterList(ctx context.Context, _key string, data []byte) ([]byte, error) {
+	if !listKey(_key) || !app.acl.active() {
+		return data, nil
+	}
+	subject := aclSubjectOf(ctx)
+	if app.acl.allowed(subject, OpRead, _key) {
+		return data, nil
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		return data, nil
+	}
+	var items []json.RawMessage
+	err := json.Unmarshal(trimmed, &items)
+	if err != nil {
+		return nil, err
+	}
+	prefix := strings.TrimSuffix(_key, "*")
+	allowed := []json.RawMessage{}
+	for _, item := range items {
+		var entry struct {
+			Index string `json:"index"`
+		}
+		err = json.Unmarshal(item, &entry)
+		if err != nil {
+			return nil, err
+		}
+		if app.acl.allowed(subject, OpRead, prefix+entry.Index) {
+			allowed = append(allowed, item)
+		}
+	}
+	return json.Marshal(allowed)
+}
+
+// filterStats removes the reserved keys and the keys that the caller can't read from a stats listing
+func (app *Server) filterStats(ctx context.Context, stats []byte) ([]byte, error) {
+	var listing Stats
+	err := json.Unmarshal(stats, &listing)
+	if err != nil {
+		return nil, err
+	}
+	listing.Keys = app.filterKeys(ctx, publicKeys(listing.Keys))
+	return json.Marshal(listing)
+}
+
+// readable checks if the caller can read a key
+func (app *Server) readable(ctx context.Context, _key string) bool {
+	return !app.acl.active() || app.acl.allowed(aclSubjectOf(ctx), OpRead, _key)
+}
+
+// filterKeys removes the keys that the caller can't read
+func (app *Server) filterKeys(ctx context.Context, keys []string) []string {
+	if !app.acl.active() {
+		return keys
+	}
+	subject := aclSubjectOf(ctx)
+	allowed := []string{}
+	for _, k := range keys {
+		if app.acl.allowed(subject, OpRead, k) {
+			allowed = append(allowed, k)
+		}
+	}
+	return allowed
+}
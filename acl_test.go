@@ -0,0 +1,150 @@
+package katamari
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func aclRequest(t *testing.T, app *Server, method string, path string, token string, body []byte) *http.Response {
+	req := httptest.NewRequest(method, path, bytes.NewBuffer(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	return w.Result()
+}
+
+func TestACL(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Auth = &TokenAuth{Secret: []byte("secret"), Optional: true}
+	app.Allow(ACLRule{Path: "reports/*", Roles: []string{"viewer"}, Operations: []string{OpRead}})
+	app.Allow(ACLRule{Path: "users/{self}/*", Roles: []string{"*"}, Operations: []string{"*"}})
+	app.Allow(ACLRule{Path: "teams/{team}", Roles: []string{"*"}, Operations: []string{OpRead}})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	viewer, err := app.Auth.Sign(Claims{"sub": "vic", "roles": []string{"viewer"}})
+	require.NoError(t, err)
+	ana, err := app.Auth.Sign(Claims{"sub": "ana", "team": "blue"})
+	require.NoError(t, err)
+	wildcard, err := app.Auth.Sign(Claims{"sub": "*"})
+	require.NoError(t, err)
+
+	_, err = app.Storage.Set("reports/1", messages.Encode([]byte(`{"total":1}`)))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("teams/blue", messages.Encode([]byte(`{"name":"blue"}`)))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("teams/red", messages.Encode([]byte(`{"name":"red"}`)))
+	require.NoError(t, err)
+	body := []byte(`{"data":"` + messages.Encode([]byte(`{"name":"one"}`)) + `"}`)
+
+	require.Equal(t, http.StatusOK, aclRequest(t, &app, "GET", "/reports/1", viewer, nil).StatusCode)
+	require.Equal(t, http.StatusForbidden, aclRequest(t, &app, "GET", "/reports/1", ana, nil).StatusCode)
+	require.Equal(t, http.StatusForbidden, aclRequest(t, &app, "GET", "/reports/1", "", nil).StatusCode)
+	require.Equal(t, http.StatusForbidden, aclRequest(t, &app, "POST", "/reports/1", viewer, body).StatusCode)
+
+	require.Equal(t, http.StatusOK, aclRequest(t, &app, "POST", "/users/ana/1", ana, body).StatusCode)
+	require.Equal(t, http.StatusForbidden, aclRequest(t, &app, "POST", "/users/vic/1", ana, body).StatusCode)
+	require.Equal(t, http.StatusForbidden, aclRequest(t, &app, "POST", "/users/ana/2", wildcard, body).StatusCode)
+	require.Equal(t, http.StatusOK, aclRequest(t, &app, "GET", "/users/ana/1", ana, nil).StatusCode)
+	require.Equal(t, http.StatusForbidden, aclRequest(t, &app, "GET", "/users/ana/1", viewer, nil).StatusCode)
+	require.Equal(t, http.StatusForbidden, aclRequest(t, &app, "DELETE", "/users/ana/1", viewer, nil).StatusCode)
+	require.Equal(t, http.StatusOK, aclRequest(t, &app, "GET", "/teams/blue", ana, nil).StatusCode)
+	require.Equal(t, http.StatusForbidden, aclRequest(t, &app, "GET", "/teams/red", ana, nil).StatusCode)
+
+	// list results only hold the readable items
+	resp := aclRequest(t, &app, "GET", "/teams/*", ana, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	list, err := objects.DecodeList(data)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(list))
+	require.Equal(t, "blue", list[0].Index)
+
+	resp = aclRequest(t, &app, "GET", "/", ana, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	data, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var stats Stats
+	err = json.Unmarshal(data, &stats)
+	require.NoError(t, err)
+	require.Equal(t, []string{"teams/blue", "users/ana/1"}, stats.Keys)
+
+	resp = aclRequest(t, &app, "GET", KeysPath, viewer, nil)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	data, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var page KeysPage
+	err = json.Unmarshal(data, &page)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(page.Keys))
+	require.Equal(t, "reports/1", page.Keys[0].Key)
+
+	// subscriptions require the glob to be granted
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/reports/*"}
+	dialer := websocket.Dialer{Subprotocols: []string{"bearer", viewer}}
+	c, _, err := dialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	c.Close()
+	dialer = websocket.Dialer{Subprotocols: []string{"bearer", ana}}
+	_, resp, err = dialer.Dial(u.String(), nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+	require.Equal(t, http.StatusNoContent, aclRequest(t, &app, "DELETE", "/users/ana/1", ana, nil).StatusCode)
+}
+
+func TestACLLoad(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "acl.json")
+	err := os.WriteFile(path, []byte(`[
+		{"path": "notes/{self}", "roles": ["*"], "operations": ["read", "write"]},
+		{"path": "notes/*", "roles": ["admin"], "operations": ["*"]}
+	]`), 0644)
+	require.NoError(t, err)
+
+	app := Server{}
+	app.Silence = true
+	app.AuditV2 = func(r *http.Request, operation string, key string) (interface{}, error) {
+		return r.Header.Get("User"), nil
+	}
+	err = app.LoadACL(path)
+	require.NoError(t, err)
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	body := []byte(`{"data":"` + messages.Encode([]byte(`{"name":"one"}`)) + `"}`)
+	req := httptest.NewRequest("POST", "/notes/ana", bytes.NewBuffer(body))
+	req.Header.Set("User", "ana")
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	req = httptest.NewRequest("DELETE", "/notes/ana", nil)
+	req.Header.Set("User", "ana")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusForbidden, w.Result().StatusCode)
+
+	err = os.WriteFile(path, []byte(`[{"path": "notes/*"}]`), 0644)
+	require.NoError(t, err)
+	require.Error(t, app.LoadACL(path))
+	require.Error(t, app.LoadACL(filepath.Join(dir, "missing.json")))
+}
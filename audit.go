@@ -0,0 +1,127 @@
+package katamari
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/benitogf/katamari/key"
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/goccy/go-json"
+)
+
+// AuditPath reserved prefix of the audit log entries, readable but never writable through the api
+const AuditPath = "_audit"
+
+var errAuditReadOnly = withCode(ErrForbidden, errors.New("katamari: auditError the audit log is read only"))
+
+// AuditEntry record of a successful publish or unpublish
+//
+// Identity: caller identity returned by AuditV2 or the claims of the token
+//
+// Operation: OpWrite or OpDelete
+//
+// Timestamp: time of the change in nanoseconds
+//
+// Before, After: sha256 digests of the data before and after the change, only set with AuditDigest
+type AuditEntry struct {
+	Identity  interface{} `json:"identity,omitempty"`
+	Key       string      `json:"key"`
+	Operation string      `json:"operation"`
+	Timestamp int64       `json:"timestamp"`
+	Before    string      `json:"before,omitempty"`
+	After     string      `json:"after,omitempty"`
+}
+
+// reservedKey checks if a key or glob belongs to the audit log or the webhook queue
+func reservedKey(_key string) bool {
+	for _, reserved := range []string{AuditPath, WebhookPath} {
+		if _key == reserved || strings.HasPrefix(_key, reserved+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// matchStored checks if a stored key matches a glob, reserved keys only match the globs that name their prefix
+// so a glob like "*/*" can't read or delete the audit log and the webhook queue
+func matchStored(path string, _key string) bool {
+	return key.Match(path, _key) && (!reservedKey(_key) || reservedKey(path))
+}
+
+// publicKeys removes the reserved keys from a listing
+func publicKeys(keys []string) []string {
+	public := []string{}
+	for _, k := range keys {
+		if !reservedKey(k) {
+			public = append(public, k)
+		}
+	}
+	return public
+}
+
+// validAuditKey an audit log key or glob that can be read
+func validAuditKey(_key string) bool {
+	return strings.HasPrefix(_key, AuditPath+"/") && key.IsValid(_key[1:])
+}
+
+// digest of the stored data, empty if there is none
+func digest(data string) string {
+	if data == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+// auditBefore data of a key before a change, empty unless the digests are enabled
+func (app *Server) auditBefore(_key string) string {
+	if !app.AuditLog || !app.AuditDigest || strings.Contains(_key, "*") {
+		return ""
+	}
+	raw, err := app.Storage.Get(_key)
+	if err != nil || len(raw) == 0 {
+		return ""
+	}
+	obj, err := objects.DecodeRaw(raw)
+	if err != nil {
+		return ""
+	}
+	return obj.Data
+}
+
+// auditEntry of a change, nil when the audit log is disabled
+func (app *Server) auditEntry(c *change) *AuditEntry {
+	if !app.AuditLog {
+		return nil
+	}
+	entry := &AuditEntry{
+		Identity:  Identity(c.ctx),
+		Key:       c.key,
+		Operation: c.operation,
+		Timestamp: c.timestamp,
+	}
+	if app.AuditDigest {
+		entry.Before = digest(c.before)
+		entry.After = digest(c.after)
+	}
+	return entry
+}
+
+// recordAudit appends an entry to the audit log through the storage
+func (app *Server) recordAudit(entry *AuditEntry) {
+	if entry == nil {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		app.Console.Err("auditError["+entry.Key+"]", err)
+		return
+	}
+	_, err = app.Storage.Set(AuditPath+"/"+app.uniqueIndex(entry.Timestamp), messages.Encode(data))
+	if err != nil {
+		app.Console.Err("auditError["+entry.Key+"]", err)
+	}
+}
@@ -0,0 +1,251 @@
+package katamari
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func auditEntries(t *testing.T, app *Server) []AuditEntry {
+	req := httptest.NewRequest("GET", "/_audit/*", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	list, err := objects.DecodeList(body)
+	require.NoError(t, err)
+	entries := make([]AuditEntry, len(list))
+	for i, obj := range list {
+		err = json.Unmarshal([]byte(obj.Data), &entries[i])
+		require.NoError(t, err)
+	}
+	// lists are sorted by the latest change first
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.AuditLog = true
+	app.AuditDigest = true
+	app.AuditV2 = func(r *http.Request, operation string, key string) (interface{}, error) {
+		return r.Header.Get("User"), nil
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/_audit/*"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+
+	data := messages.Encode([]byte(`{"name":"one"}`))
+	req := httptest.NewRequest("POST", "/things/1", bytes.NewBufferString(`{"data":"`+data+`"}`))
+	req.Header.Set("User", "ana")
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	// subscribers of the audit log get the entries
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+
+	req = httptest.NewRequest("PATCH", "/things/1", bytes.NewBufferString(`{"age":2}`))
+	req.Header.Set("User", "ben")
+	req.Header.Set("Content-Type", MergePatchType)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	req = httptest.NewRequest("POST", "/_batch", bytes.NewBufferString(`[{"method":"POST","key":"things/2","data":"`+data+`"}]`))
+	req.Header.Set("User", "eva")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	req = httptest.NewRequest("DELETE", "/things/1", nil)
+	req.Header.Set("User", "dan")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+
+	// failed writes are not recorded
+	req = httptest.NewRequest("POST", "/things/3", bytes.NewBufferString(`not json`))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	entries := auditEntries(t, &app)
+	require.Equal(t, 4, len(entries))
+	require.Equal(t, "ana", entries[0].Identity)
+	require.Equal(t, "things/1", entries[0].Key)
+	require.Equal(t, OpWrite, entries[0].Operation)
+	require.Equal(t, "", entries[0].Before)
+	require.Equal(t, digest(data), entries[0].After)
+	require.Equal(t, "ben", entries[1].Identity)
+	require.Equal(t, entries[0].After, entries[1].Before)
+	require.NotEqual(t, entries[1].Before, entries[1].After)
+	require.Equal(t, "eva", entries[2].Identity)
+	require.Equal(t, "things/2", entries[2].Key)
+	require.Equal(t, "dan", entries[3].Identity)
+	require.Equal(t, OpDelete, entries[3].Operation)
+	require.Equal(t, entries[1].After, entries[3].Before)
+	require.Equal(t, "", entries[3].After)
+	require.Less(t, entries[0].Timestamp, entries[3].Timestamp)
+}
+
+func TestAuditLogReadOnly(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.AuditLog = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	data := messages.Encode([]byte(`{"name":"one"}`))
+	req := httptest.NewRequest("POST", "/things/1", bytes.NewBufferString(`{"data":"`+data+`"}`))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	entries := auditEntries(t, &app)
+	require.Equal(t, 1, len(entries))
+	require.Equal(t, "", entries[0].After)
+
+	for _, method := range []string{"POST", "DELETE", "PATCH"} {
+		req = httptest.NewRequest(method, "/_audit/1", bytes.NewBufferString(`{"data":"`+data+`"}`))
+		w = httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusMethodNotAllowed, w.Result().StatusCode, method)
+	}
+
+	req = httptest.NewRequest("POST", "/_batch", bytes.NewBufferString(`[{"method":"POST","key":"_audit/1","data":"`+data+`"},{"method":"DELETE","key":"_audit/*"}]`))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	body, err := io.ReadAll(w.Result().Body)
+	require.NoError(t, err)
+	var results []BatchResult
+	err = json.Unmarshal(body, &results)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusBadRequest, results[0].Status)
+	require.Equal(t, http.StatusBadRequest, results[1].Status)
+
+	_, err = app.authorize(httptest.NewRequest("POST", "/", nil), OpWrite, "_audit/1")
+	require.ErrorIs(t, err, ErrForbidden)
+	_, err = app.authorize(httptest.NewRequest("DELETE", "/", nil), OpDelete, "_audit/*")
+	require.ErrorIs(t, err, ErrForbidden)
+	require.Equal(t, 1, len(auditEntries(t, &app)))
+}
+
+func TestAuditLogListing(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.AuditLog = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	data := messages.Encode([]byte(`{"name":"one"}`))
+	for _, path := range []string{"/things/1", "/things/2", "/things/3"} {
+		req := httptest.NewRequest("POST", path, bytes.NewBufferString(`{"data":"`+data+`"}`))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	}
+	require.Len(t, auditEntries(t, &app), 3)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	var stats Stats
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	require.Equal(t, []string{"things/1", "things/2", "things/3"}, stats.Keys)
+
+	for query, count := range map[string]int{"": 3, "?prefix=_": 0, "?prefix=" + AuditPath: 0} {
+		req = httptest.NewRequest("GET", KeysPath+query, nil)
+		w = httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+		var page KeysPage
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page), query)
+		require.Len(t, page.Keys, count, query)
+	}
+}
+
+func TestAuditLogGlobs(t *testing.T) {
+	t.Parallel()
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer target.Close()
+
+	app := Server{}
+	app.Silence = true
+	app.AuditLog = true
+	app.WebhookBackoff = time.Minute
+	app.Webhook("things/*", target.URL, "secret")
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	data := messages.Encode([]byte(`{"name":"one"}`))
+	req := httptest.NewRequest("POST", "/things/1", bytes.NewBufferString(`{"data":"`+data+`"}`))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Len(t, auditEntries(t, &app), 1)
+	require.Eventually(t, func() bool {
+		queue, err := app.deliveries(webhookQueue)
+		require.NoError(t, err)
+		return len(queue) == 1 && queue[0].Attempts == 1
+	}, 2*time.Second, 10*time.Millisecond)
+
+	// globs that don't name the reserved prefixes don't reach the audit log or the webhook queue
+	globs := []string{"/*/*", "/*/*/*", "/*/*/*/*"}
+	for i, glob := range globs {
+		req = httptest.NewRequest("GET", glob, nil)
+		w = httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode, glob)
+		list, err := objects.DecodeList(w.Body.Bytes())
+		require.NoError(t, err)
+		// only things/1 is public
+		require.Len(t, list, 1-min(i, 1), glob)
+	}
+	for _, glob := range globs {
+		req = httptest.NewRequest("DELETE", glob, nil)
+		w = httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusNoContent, w.Result().StatusCode, glob)
+	}
+	status, _ := batchCall(t, &app, "/_batch", `[{"method":"DELETE","key":"*/*/*"}]`)
+	require.Equal(t, http.StatusOK, status)
+
+	// the deletes are audited next to the write
+	entries := auditEntries(t, &app)
+	require.Len(t, entries, 2+len(globs))
+	require.Equal(t, "things/1", entries[0].Key)
+	queue, err := app.deliveries(webhookQueue)
+	require.NoError(t, err)
+	require.Len(t, queue, 1)
+}
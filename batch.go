@@ -0,0 +1,432 @@
+package katamari
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/benitogf/katamari/key"
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/cristalhq/base64"
+	"github.com/goccy/go-json"
+	"github.com/gorilla/mux"
+)
+
+// BatchOperation a single operation of a batch request
+//
+// Method: GET, POST or DELETE
+//
+// Key: key of the operation, POST accepts a trailing glob to push into a list
+//
+// Data: base64 encoded data of a POST, embedded json in raw mode
+type BatchOperation struct {
+	Method string          `json:"method"`
+	Key    string          `json:"key"`
+	Data   json.RawMessage `json:"data,omitempty"`
+}
+
+// BatchResult outcome of a batch operation
+//
+// Status: http status code of the operation
+//
+// Index: index of a POST operation
+//
+// Data: result of a GET operation
+//
+// Code: stable error code of a failed operation
+//
+// Error: reason of a failed operation
+type BatchResult struct {
+	Status int             `json:"status"`
+	Index  string          `json:"index,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	Code   string          `json:"code,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// batchOp an operation that passed validation, audit and filters
+type batchOp struct {
+	ctx    context.Context
+	method string
+	key    string
+	data   []byte
+}
+
+// batchSnapshot previous state of a key, used to roll back atomic batches
+type batchSnapshot struct {
+	key   string
+	found bool
+	obj   objects.Object
+}
+
+var (
+	errBatchAborted = errors.New("katamari: batch aborted")
+	errBatchMethod  = withCode(ErrMethodNotAllowed, errors.New("katamari: batch method not allowed"))
+	errEmptyData    = withCode(ErrInvalidData, errors.New("katamari: empty data"))
+)
+
+func failedOp(err error) BatchResult {
+	status, code := errorStatus(err)
+	return BatchResult{
+		Status: status,
+		Code:   code,
+		Error:  err.Error(),
+	}
+}
+
+// batchOperations rate limited operation of each batch method
+var batchOperations = map[string]string{
+	"GET":    OpRead,
+	"POST":   OpWrite,
+	"DELETE": OpDelete,
+}
+
+// abortedOp result of an operation that was not applied because another one failed
+func abortedOp() BatchResult {
+	return BatchResult{
+		Status: http.StatusFailedDependency,
+		Code:   "aborted",
+		Error:  errBatchAborted.Error(),
+	}
+}
+
+// batchRequest builds the request of an operation to be audited
+func batchRequest(r *http.Request, method string, _key string) *http.Request {
+	req := r.Clone(r.Context())
+	req.Method = method
+	req.URL.Path = "/" + _key
+	req.RequestURI = req.URL.RequestURI()
+	req.Body = http.NoBody
+	return mux.SetURLVars(req, map[string]string{"key": _key})
+}
+
+// prepareBatch validates, audits and filters an operation
+func (app *Server) prepareBatch(r *http.Request, operation BatchOperation, raw bool) (batchOp, BatchResult) {
+	method := strings.ToUpper(operation.Method)
+	op := batchOp{
+		method: method,
+		key:    operation.Key,
+	}
+	switch method {
+	case "GET":
+		if !key.IsValid(operation.Key) && !validAuditKey(operation.Key) {
+			return op, failedOp(ErrInvalidKey)
+		}
+	case "DELETE":
+		if !key.IsValid(operation.Key) {
+			return op, failedOp(ErrInvalidKey)
+		}
+	case "POST":
+		if !validPublishKey(operation.Key) {
+			return op, failedOp(ErrInvalidKey)
+		}
+	default:
+		return op, failedOp(errBatchMethod)
+	}
+
+	req, err := app.authorize(batchRequest(r, method, operation.Key), batchOperations[method], operation.Key)
+	if err != nil {
+		return op, failedOp(err)
+	}
+	op.ctx = req.Context()
+
+	allowed, _ := app.rateLimiter.take(operation.Key, batchOperations[method], app.RateLimitIdentity(req), time.Now())
+	if !allowed {
+		return op, failedOp(ErrTooManyRequests)
+	}
+
+	switch method {
+	case "GET":
+		err := app.filters.Read.checkStatic(operation.Key, app.Static)
+		if err != nil {
+			return op, failedOp(err)
+		}
+	case "DELETE":
+		err := app.filters.Delete.check(op.ctx, operation.Key, app.Static)
+		if err != nil {
+			return op, failedOp(err)
+		}
+	case "POST":
+		limit := app.bodyLimit(operation.Key)
+		if limit > 0 && int64(len(operation.Data)) > limit {
+			return op, failedOp(ErrTooLarge)
+		}
+		data, err := batchData(operation.Data, raw)
+		if err != nil {
+			return op, failedOp(withCode(ErrInvalidData, err))
+		}
+		op.key = key.Build(operation.Key)
+		op.data, err = app.filters.Write.check(op.ctx, op.key, data, app.Static)
+		if err != nil {
+			return op, failedOp(err)
+		}
+	}
+
+	return op, BatchResult{}
+}
+
+// batchData decodes the data of a POST operation into its base64 form
+func batchData(data json.RawMessage, raw bool) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, errEmptyData
+	}
+	if raw {
+		return []byte(messages.Encode(data)), nil
+	}
+
+	var encoded string
+	err := json.Unmarshal(data, &encoded)
+	if err != nil {
+		return nil, err
+	}
+	if encoded == "" {
+		return nil, errEmptyData
+	}
+	_, err = base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(encoded), nil
+}
+
+// execBatch runs a prepared operation, after filters and the record of the change are left to the caller
+func (app *Server) execBatch(op batchOp, raw bool) (BatchResult, *change) {
+	switch op.method {
+	case "GET":
+		entry, err := app.fetch(op.ctx, op.key)
+		if err != nil {
+			return failedOp(err), nil
+		}
+		if string(entry.Data) == string(objects.EmptyObject) {
+			return failedOp(errEmptyKey), nil
+		}
+		data, err := app.filterList(op.ctx, op.key, entry.Data)
+		if err != nil {
+			return failedOp(withCode(ErrInternal, err)), nil
+		}
+		if raw {
+			data, err = objects.ToRaw(data)
+			if err != nil {
+				return failedOp(withCode(ErrNotAcceptable, err)), nil
+			}
+		}
+		return BatchResult{
+			Status: http.StatusOK,
+			Data:   data,
+		}, nil
+	case "POST":
+		before := app.auditBefore(op.key)
+		index, err := app.Storage.Set(op.key, string(op.data))
+		if err != nil {
+			return failedOp(withCode(ErrInternal, err)), nil
+		}
+		app.Console.Log("publish", op.key)
+		return BatchResult{
+			Status: http.StatusOK,
+			Index:  index,
+		}, newChange(op.ctx, OpWrite, op.key, before, string(op.data)).withVersion(app.storedVersion(op.key))
+	}
+
+	before := app.auditBefore(op.key)
+	err := app.Storage.Del(op.key)
+	if err != nil {
+		return failedOp(withCode(ErrInternal, err)), nil
+	}
+	app.Console.Log("unpublish", op.key)
+	return BatchResult{
+		Status: http.StatusNoContent,
+	}, newChange(op.ctx, OpDelete, op.key, before, "")
+}
+
+// snapshotBatch captures the current state of the keys a write operation will modify
+func (app *Server) snapshotBatch(op batchOp) ([]batchSnapshot, error) {
+	keys := []string{op.key}
+	if strings.Contains(op.key, "*") {
+		var err error
+		keys, err = app.Storage.KeysRange(op.key, 0, math.MaxInt64)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	snapshots := []batchSnapshot{}
+	for _, k := range keys {
+		raw, err := app.Storage.Get(k)
+		if err != nil || len(raw) == 0 {
+			snapshots = append(snapshots, batchSnapshot{key: k})
+			continue
+		}
+		obj, err := objects.DecodeRaw(raw)
+		if err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, batchSnapshot{key: k, found: true, obj: obj})
+	}
+	return snapshots, nil
+}
+
+// rollbackBatch restores snapshots in reverse order
+func (app *Server) rollbackBatch(snapshots []batchSnapshot) {
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		snapshot := snapshots[i]
+		if !snapshot.found {
+			_ = app.Storage.Del(snapshot.key)
+			continue
+		}
+		_, err := app.Storage.Pivot(snapshot.key, snapshot.obj.Data, snapshot.obj.Created, snapshot.obj.Updated)
+		if err != nil {
+			app.Console.Err("batchRollbackError["+snapshot.key+"]", err)
+		}
+	}
+}
+
+// atomicBatch runs prepared operations, a failed write rolls back the previous ones.
+// Every operation is validated, audited and filtered before the first write so only a storage
+// error can fail a write, the rollback goes through the storage as well: the subscribers of the
+// keys receive the partial writes and then their undo
+func (app *Server) atomicBatch(ops []batchOp, results []BatchResult, raw bool) bool {
+	writeKeys := []string{}
+	for _, op := range ops {
+		if op.method != "GET" {
+			writeKeys = append(writeKeys, op.key)
+		}
+	}
+
+	unlock := app.keyLocks.lockAll(writeKeys)
+	snapshots := []batchSnapshot{}
+	changes := []*change{}
+	for i, op := range ops {
+		if op.method != "GET" {
+			snapshot, err := app.snapshotBatch(op)
+			if err != nil {
+				results[i] = failedOp(withCode(ErrInternal, err))
+				app.rollbackBatch(snapshots)
+				unlock()
+				abortBatch(results, i)
+				return false
+			}
+			snapshots = append(snapshots, snapshot...)
+		}
+
+		var c *change
+		results[i], c = app.execBatch(op, raw)
+		if op.method != "GET" && results[i].Status >= http.StatusBadRequest {
+			app.rollbackBatch(snapshots)
+			unlock()
+			abortBatch(results, i)
+			return false
+		}
+		changes = append(changes, c)
+	}
+	unlock()
+
+	for _, c := range changes {
+		app.changed(c)
+	}
+
+	for _, op := range ops {
+		if op.method == "POST" {
+			app.filters.After.check(op.ctx, op.key)
+		}
+	}
+	return true
+}
+
+// abortBatch marks every operation other than the failed one as aborted
+func abortBatch(results []BatchResult, failed int) {
+	for i := range results {
+		if i != failed {
+			results[i] = abortedOp()
+		}
+	}
+}
+
+func writeBatch(w http.ResponseWriter, status int, results []BatchResult) {
+	response, err := objects.Encode(results)
+	if err != nil {
+		writeError(w, "", withCode(ErrInternal, err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(response)
+}
+
+// batch runs a group of operations in one request
+//
+// with the atomic flag the writes are all-or-nothing, an operation that fails validation, audit or
+// a filter aborts the batch before anything is written
+func (app *Server) batch(w http.ResponseWriter, r *http.Request) {
+	raw := rawContent(r)
+	flag := r.URL.Query().Get("atomic")
+	atomic := flag == "1" || flag == "true"
+
+	if !limitBody(w, r, "", app.MaxBodySize) {
+		return
+	}
+
+	body, err := readBody(r)
+	if err != nil {
+		writeError(w, "", withCode(ErrInvalidData, err))
+		return
+	}
+
+	var operations []BatchOperation
+	err = json.NewDecoder(body).Decode(&operations)
+	if err != nil {
+		writeError(w, "", withCode(ErrInvalidData, err))
+		return
+	}
+
+	results := make([]BatchResult, len(operations))
+	if !atomic {
+		for i, operation := range operations {
+			op, result := app.prepareBatch(r, operation, raw)
+			if result.Status != 0 {
+				results[i] = result
+				continue
+			}
+			var c *change
+			if op.method == "GET" {
+				results[i], c = app.execBatch(op, raw)
+			} else {
+				// serialized with the read-modify-write of a patch on the same keys
+				unlock := app.keyLocks.lockAll([]string{op.key})
+				results[i], c = app.execBatch(op, raw)
+				unlock()
+			}
+			app.changed(c)
+			if op.method == "POST" && results[i].Status == http.StatusOK {
+				app.filters.After.check(op.ctx, op.key)
+			}
+		}
+		writeBatch(w, http.StatusOK, results)
+		return
+	}
+
+	ops := make([]batchOp, len(operations))
+	failed := false
+	for i, operation := range operations {
+		ops[i], results[i] = app.prepareBatch(r, operation, raw)
+		failed = failed || results[i].Status != 0
+	}
+	if failed {
+		for i := range results {
+			if results[i].Status == 0 {
+				results[i] = abortedOp()
+			}
+		}
+		writeBatch(w, http.StatusBadRequest, results)
+		return
+	}
+
+	if !app.atomicBatch(ops, results, raw) {
+		writeBatch(w, http.StatusInternalServerError, results)
+		return
+	}
+	writeBatch(w, http.StatusOK, results)
+}
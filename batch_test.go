@@ -0,0 +1,168 @@
+package katamari
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/require"
+)
+
+func batchCall(t *testing.T, app *Server, url string, body string) (int, []BatchResult) {
+	req := httptest.NewRequest("POST", url, bytes.NewBufferString(body))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	raw, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var results []BatchResult
+	err = json.Unmarshal(raw, &results)
+	require.NoError(t, err, string(raw))
+	return resp.StatusCode, results
+}
+
+func TestBatch(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Audit = func(r *http.Request) bool {
+		return r.URL.Path != "/secret"
+	}
+	app.WriteFilter("filtered", func(key string, data []byte) ([]byte, error) {
+		return nil, errors.New("filtered")
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("old", messages.Encode([]byte(`{"old":true}`)))
+	require.NoError(t, err)
+
+	data := messages.Encode([]byte(`{"name":"one"}`))
+	status, results := batchCall(t, &app, "/_batch", `[`+
+		`{"method":"POST","key":"thing","data":"`+data+`"},`+
+		`{"method":"POST","key":"things/*","data":"`+data+`"},`+
+		`{"method":"GET","key":"thing"},`+
+		`{"method":"DELETE","key":"old"},`+
+		`{"method":"GET","key":"secret"},`+
+		`{"method":"POST","key":"filtered","data":"`+data+`"},`+
+		`{"method":"PUT","key":"thing"}`+
+		`]`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, 7, len(results))
+	require.Equal(t, http.StatusOK, results[0].Status)
+	require.Equal(t, "thing", results[0].Index)
+	require.Equal(t, http.StatusOK, results[1].Status)
+	require.NotEmpty(t, results[1].Index)
+	require.Equal(t, http.StatusOK, results[2].Status)
+	obj, err := objects.Decode(results[2].Data)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"one"}`, obj.Data)
+	require.Equal(t, http.StatusNoContent, results[3].Status)
+	require.Equal(t, http.StatusUnauthorized, results[4].Status)
+	require.Equal(t, http.StatusBadRequest, results[5].Status)
+	require.Equal(t, http.StatusMethodNotAllowed, results[6].Status)
+
+	_, err = app.Storage.Get("old")
+	require.Error(t, err)
+}
+
+func TestBatchAtomic(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.WriteFilter("filtered", func(key string, data []byte) ([]byte, error) {
+		return nil, errors.New("filtered")
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("thing", messages.Encode([]byte(`{"name":"zero"}`)))
+	require.NoError(t, err)
+
+	data := messages.Encode([]byte(`{"name":"one"}`))
+	// a filtered write aborts the whole batch
+	status, results := batchCall(t, &app, "/_batch?atomic=1", `[`+
+		`{"method":"POST","key":"thing","data":"`+data+`"},`+
+		`{"method":"POST","key":"filtered","data":"`+data+`"}`+
+		`]`)
+	require.Equal(t, http.StatusBadRequest, status)
+	require.Equal(t, http.StatusFailedDependency, results[0].Status)
+	require.Equal(t, http.StatusBadRequest, results[1].Status)
+	raw, err := app.Storage.Get("thing")
+	require.NoError(t, err)
+	obj, err := objects.Decode(raw)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"zero"}`, obj.Data)
+
+	// a failed delete rolls back the previous writes
+	status, results = batchCall(t, &app, "/_batch?atomic=true", `[`+
+		`{"method":"POST","key":"thing","data":"`+data+`"},`+
+		`{"method":"POST","key":"other","data":"`+data+`"},`+
+		`{"method":"DELETE","key":"missing"}`+
+		`]`)
+	require.Equal(t, http.StatusInternalServerError, status)
+	require.Equal(t, http.StatusFailedDependency, results[0].Status)
+	require.Equal(t, http.StatusFailedDependency, results[1].Status)
+	require.Equal(t, http.StatusNotFound, results[2].Status)
+	raw, err = app.Storage.Get("thing")
+	require.NoError(t, err)
+	obj, err = objects.Decode(raw)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"zero"}`, obj.Data)
+	_, err = app.Storage.Get("other")
+	require.Error(t, err)
+
+	status, results = batchCall(t, &app, "/_batch?atomic=true", `[`+
+		`{"method":"POST","key":"thing","data":"`+data+`"},`+
+		`{"method":"POST","key":"other","data":"`+data+`"}`+
+		`]`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, http.StatusOK, results[0].Status)
+	require.Equal(t, http.StatusOK, results[1].Status)
+	raw, err = app.Storage.Get("other")
+	require.NoError(t, err)
+	obj, err = objects.Decode(raw)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"one"}`, obj.Data)
+}
+
+func TestBatchLocks(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("things/1", messages.Encode([]byte(`{"name":"one"}`)))
+	require.NoError(t, err)
+
+	// the writes of a batch wait for a patch holding the key
+	for _, body := range []string{
+		`[{"method":"POST","key":"things/1","data":"` + messages.Encode([]byte(`{"name":"two"}`)) + `"}]`,
+		`[{"method":"DELETE","key":"things/*"}]`,
+	} {
+		unlock := app.keyLocks.lock("things/1")
+		done := make(chan int)
+		go func() {
+			status, _ := batchCall(t, &app, "/_batch", body)
+			done <- status
+		}()
+		select {
+		case <-done:
+			t.Fatal("batch write didn't wait for the key lock")
+		case <-time.After(50 * time.Millisecond):
+		}
+		unlock()
+		require.Equal(t, http.StatusOK, <-done)
+	}
+	_, err = app.Storage.Get("things/1")
+	require.Error(t, err)
+}
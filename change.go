@@ -0,0 +1,60 @@
+package katamari
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// change of a key made through the api
+//
+// before, after: stored data of the key around the change, before is only read when it's needed
+//
+// version: version of the stored object after a write, only read when there are webhooks
+type change struct {
+	ctx       context.Context
+	operation string
+	key       string
+	before    string
+	after     string
+	version   int64
+	timestamp int64
+}
+
+func newChange(ctx context.Context, operation string, _key string, before string, after string) *change {
+	return &change{
+		ctx:       ctx,
+		operation: operation,
+		key:       _key,
+		before:    before,
+		after:     after,
+		timestamp: time.Now().UTC().UnixNano(),
+	}
+}
+
+// changed records a change on the audit log and queues its webhook deliveries
+func (app *Server) changed(c *change) {
+	if c == nil {
+		return
+	}
+	app.recordAudit(app.auditEntry(c))
+	app.queueWebhooks(c)
+}
+
+// withVersion sets the version of the stored object on a change
+func (c *change) withVersion(version int64) *change {
+	c.version = version
+	return c
+}
+
+// uniqueIndex increasing index built from a timestamp, unique for the server
+func (app *Server) uniqueIndex(timestamp int64) string {
+	for {
+		last := atomic.LoadInt64(&app.indexClock)
+		next := max(timestamp, last+1)
+		if atomic.CompareAndSwapInt64(&app.indexClock, last, next) {
+			return strconv.FormatInt(next, 16)
+		}
+	}
+}
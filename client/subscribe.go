@@ -2,10 +2,13 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,6 +21,28 @@ import (
 
 var HandshakeTimeout time.Duration = time.Second * 2
 
+// TLSConfig used by the subscriptions on the wss protocol, nil uses the default configuration
+var TLSConfig *tls.Config
+
+// UnixPrefix of a host that points to a unix domain socket, as in "unix:/run/katamari.sock"
+const UnixPrefix = "unix:"
+
+// UnixSocket path of a host with the unix prefix, empty for network hosts
+func UnixSocket(host string) string {
+	if !strings.HasPrefix(host, UnixPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(host, UnixPrefix)
+}
+
+// URLHost host of the request urls, unix sockets are requested as localhost
+func URLHost(host string) string {
+	if UnixSocket(host) != "" {
+		return "localhost"
+	}
+	return host
+}
+
 type Meta[T any] struct {
 	Created int64  `json:"created"`
 	Updated int64  `json:"updated"`
@@ -39,7 +64,8 @@ func Subscribe[T any](ctx context.Context, protocol, host, path string, callback
 	lastPath := key.LastIndex(path)
 	isList := lastPath == "*"
 	closingTime := atomic.Bool{}
-	wsURL := url.URL{Scheme: protocol, Host: host, Path: path}
+	wsURL := url.URL{Scheme: protocol, Host: URLHost(host), Path: "/" + path, RawPath: "/" + key.Escape(path)}
+	socket := UnixSocket(host)
 	muWsClient := sync.Mutex{}
 	var wsClient *websocket.Conn
 	_handShakeTimeout := HandshakeTimeout
@@ -62,6 +88,14 @@ func Subscribe[T any](ctx context.Context, protocol, host, path string, callback
 		quickDial := &websocket.Dialer{
 			Proxy:            http.ProxyFromEnvironment,
 			HandshakeTimeout: _handShakeTimeout,
+			TLSClientConfig:  TLSConfig,
+		}
+		if socket != "" {
+			quickDial.Proxy = nil
+			quickDial.NetDialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			}
 		}
 
 		muWsClient.Lock()
@@ -1,8 +1,6 @@
 package katamari
 
 import (
-	"errors"
-	"fmt"
 	"net/http"
 	"strconv"
 	"time"
@@ -32,9 +30,9 @@ func (app *Server) tick() {
 }
 
 func (app *Server) clock(w http.ResponseWriter, r *http.Request) {
-	if !app.Audit(r) {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, "%s", errors.New("katamari: this request is not authorized"))
+	r, err := app.authorize(r, OpClock, "")
+	if err != nil {
+		writeError(w, "", err)
 		app.Console.Err("socketConnectionUnauthorized time")
 		return
 	}
@@ -0,0 +1,134 @@
+package katamari
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/benitogf/katamari/objects"
+)
+
+// Sentinel errors, storages and filters can wrap them to select the response code
+var (
+	ErrNotFound             = errors.New("katamari: not found")
+	ErrInvalidKey           = errors.New("katamari: pathKeyError key is not valid")
+	ErrInvalidIndex         = errors.New("katamari: indexError index is not valid")
+	ErrInvalidData          = errors.New("katamari: invalid data")
+	ErrUnauthorized         = errors.New("katamari: this request is not authorized")
+	ErrForbidden            = errors.New("katamari: forbidden")
+	ErrFiltered             = errors.New("katamari: filtered")
+	ErrRouteNotDefined      = errors.New("route not defined")
+	ErrConflict             = errors.New("katamari: conflict")
+	ErrMethodNotAllowed     = errors.New("katamari: method not allowed")
+	ErrUnsupportedMediaType = errors.New("katamari: unsupported content type")
+	ErrNotAcceptable        = errors.New("katamari: not acceptable")
+	ErrPatchFailed          = errors.New("katamari: patch failed")
+	ErrTooLarge             = errors.New("katamari: request body too large")
+	ErrTooManyRequests      = errors.New("katamari: too many requests")
+	ErrUnavailable          = errors.New("katamari: unavailable")
+	ErrInternal             = errors.New("katamari: internal error")
+)
+
+// ErrorResponse body of a failed request
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Key     string `json:"key,omitempty"`
+}
+
+type errorCode struct {
+	err    error
+	status int
+	code   string
+}
+
+var errorCodes = []errorCode{
+	{ErrNotFound, http.StatusNotFound, "not_found"},
+	{ErrInvalidKey, http.StatusBadRequest, "invalid_key"},
+	{ErrInvalidIndex, http.StatusBadRequest, "invalid_index"},
+	{ErrInvalidData, http.StatusBadRequest, "invalid_data"},
+	{ErrUnauthorized, http.StatusUnauthorized, "unauthorized"},
+	{ErrForbidden, http.StatusForbidden, "forbidden"},
+	{ErrRouteNotDefined, http.StatusBadRequest, "route_not_defined"},
+	{ErrFiltered, http.StatusBadRequest, "filtered"},
+	{ErrConflict, http.StatusConflict, "conflict"},
+	{ErrMethodNotAllowed, http.StatusMethodNotAllowed, "method_not_allowed"},
+	{ErrUnsupportedMediaType, http.StatusUnsupportedMediaType, "unsupported_media_type"},
+	{ErrNotAcceptable, http.StatusNotAcceptable, "not_acceptable"},
+	{ErrPatchFailed, http.StatusUnprocessableEntity, "patch_failed"},
+	{ErrTooLarge, http.StatusRequestEntityTooLarge, "too_large"},
+	{ErrTooManyRequests, http.StatusTooManyRequests, "rate_limited"},
+	{ErrUnavailable, http.StatusServiceUnavailable, "unavailable"},
+	{ErrInternal, http.StatusInternalServerError, "internal"},
+}
+
+// codedError keeps the message of an error while classifying it with a sentinel
+type codedError struct {
+	sentinel error
+	err      error
+}
+
+func (e *codedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *codedError) Unwrap() []error {
+	return []error{e.sentinel, e.err}
+}
+
+// findCode of an error, storages that predate the sentinels are matched by message
+func findCode(err error) (errorCode, bool) {
+	for _, ec := range errorCodes {
+		if errors.Is(err, ec.err) {
+			return ec, true
+		}
+	}
+	if err.Error() == "leveldb: not found" {
+		return errorCodes[0], true
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return findCode(ErrTooLarge)
+	}
+	return errorCode{}, false
+}
+
+// withCode classifies an error with a sentinel unless it already wraps one
+func withCode(sentinel error, err error) error {
+	if _, found := findCode(err); found {
+		return err
+	}
+	return &codedError{sentinel: sentinel, err: err}
+}
+
+// isNotFound checks if an error means that the key doesn't exist
+func isNotFound(err error) bool {
+	ec, found := findCode(err)
+	return found && ec.err == ErrNotFound
+}
+
+// errorStatus http status and code of an error
+func errorStatus(err error) (int, string) {
+	ec, found := findCode(err)
+	if !found {
+		ec = errorCodes[len(errorCodes)-1]
+	}
+	return ec.status, ec.code
+}
+
+// writeError renders an error as json
+func writeError(w http.ResponseWriter, _key string, err error) {
+	status, code := errorStatus(err)
+	body, _ := objects.Encode(ErrorResponse{
+		Code:    code,
+		Message: err.Error(),
+		Key:     _key,
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+var (
+	errEmptyKey    = withCode(ErrNotFound, errors.New("katamari: empty key"))
+	errIndexExists = withCode(ErrConflict, errors.New("katamari: indexError index already exists"))
+)
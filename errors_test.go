@@ -0,0 +1,105 @@
+package katamari_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/benitogf/katamari"
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorResponses(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.WriteFilter("books/*", func(key string, data []byte) ([]byte, error) {
+		return nil, errors.New("books are closed")
+	})
+	app.ReadFilter("books/*", katamari.NoopFilter)
+	app.DeleteFilter("books/*", func(key string) error {
+		return fmt.Errorf("%w: books are read only", katamari.ErrUnauthorized)
+	})
+	app.Audit = func(r *http.Request) bool {
+		return r.Header.Get("Authorization") != "deny"
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	var cases = []struct {
+		method string
+		path   string
+		body   string
+		header string
+		status int
+		code   string
+		key    string
+	}{
+		{"GET", "/books/none", "", "", http.StatusNotFound, "not_found", "books/none"},
+		{"GET", "/books/none", "", "deny", http.StatusUnauthorized, "unauthorized", "books/none"},
+		{"GET", "/books/**", "", "", http.StatusBadRequest, "invalid_key", "books/**"},
+		{"POST", "/books/one", `{"data":"dGVzdA=="}`, "", http.StatusBadRequest, "filtered", "books/one"},
+		{"POST", "/books/one", `{"data":""}`, "", http.StatusBadRequest, "invalid_data", "books/one"},
+		{"DELETE", "/books/one", "", "", http.StatusUnauthorized, "unauthorized", "books/one"},
+		{"DELETE", "/things/one", "", "", http.StatusNotFound, "not_found", "things/one"},
+		{"PATCH", "/things/one", `{}`, "", http.StatusUnsupportedMediaType, "unsupported_media_type", "things/one"},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, bytes.NewBufferString(c.body))
+		if c.header != "" {
+			req.Header.Set("Authorization", c.header)
+		}
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		resp := w.Result()
+		require.Equal(t, c.status, resp.StatusCode, c.method+" "+c.path)
+		require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+		var body katamari.ErrorResponse
+		err := json.NewDecoder(resp.Body).Decode(&body)
+		require.NoError(t, err)
+		require.Equal(t, c.code, body.Code, c.method+" "+c.path)
+		require.Equal(t, c.key, body.Key)
+		require.NotEmpty(t, body.Message)
+	}
+}
+
+func TestErrorStaticMode(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.Static = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req := httptest.NewRequest("GET", "/undefined", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	var body katamari.ErrorResponse
+	err := json.NewDecoder(resp.Body).Decode(&body)
+	require.NoError(t, err)
+	require.Equal(t, "route_not_defined", body.Code)
+	require.Equal(t, "route not defined, static mode, key:undefined", body.Message)
+}
+
+func TestErrorMemoryNotFound(t *testing.T) {
+	t.Parallel()
+	db := &katamari.MemoryStorage{}
+	err := db.Start(katamari.StorageOpt{})
+	require.NoError(t, err)
+	defer db.Close()
+
+	_, err = db.Get("none")
+	require.ErrorIs(t, err, katamari.ErrNotFound)
+	err = db.Del("none")
+	require.ErrorIs(t, err, katamari.ErrNotFound)
+}
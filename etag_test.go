@@ -0,0 +1,96 @@
+package katamari_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari"
+	"github.com/benitogf/katamari/messages"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestConditionalGet(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("thing", messages.Encode([]byte(`{"name":"one"}`)))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/thing", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	tag := resp.Header.Get("ETag")
+	require.NotEmpty(t, tag)
+	modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), modified, time.Minute)
+
+	req = httptest.NewRequest("GET", "/thing", nil)
+	req.Header.Set("If-None-Match", tag)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	require.Equal(t, tag, resp.Header.Get("ETag"))
+
+	_, err = app.Storage.Set("thing", messages.Encode([]byte(`{"name":"two"}`)))
+	require.NoError(t, err)
+	// wait for the broadcast to refresh the cache version
+	time.Sleep(100 * time.Millisecond)
+
+	req = httptest.NewRequest("GET", "/thing", nil)
+	req.Header.Set("If-None-Match", tag)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEqual(t, tag, resp.Header.Get("ETag"))
+}
+
+func TestRestConditionalGetNoBroadcast(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.NoBroadcastKeys = []string{"quiet"}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("quiet", messages.Encode([]byte(`{"name":"one"}`)))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/quiet", nil)
+	req.Header.Set("If-None-Match", "*")
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Empty(t, resp.Header.Get("ETag"))
+}
+
+func TestRestConditionalGetCors(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	// browsers can send the etag on cross domain reads
+	req, err := http.NewRequest("OPTIONS", "http://"+app.Address+"/thing", nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", "http://example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	req.Header.Set("Access-Control-Request-Headers", "if-none-match")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+	require.Equal(t, "if-none-match", resp.Header.Get("Access-Control-Allow-Headers"))
+}
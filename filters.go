@@ -1,7 +1,10 @@
 package katamari
 
 import (
-	"errors"
+	"context"
+	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/benitogf/katamari/key"
 )
@@ -21,20 +24,46 @@ type ApplyDelete func(key string) error
 // Notify after a write is done
 type Notify func(key string)
 
+// ApplyCtx filter function that also receives the context of the request,
+// Identity(ctx) provides the caller identity resolved by AuditV2 and Request(ctx) the http request
+// or websocket handshake, the context is canceled when the client goes away or the deadline is reached
+type ApplyCtx func(ctx context.Context, key string, data []byte) ([]byte, error)
+
+// ApplyDeleteCtx delete callback that also receives the context of the request
+type ApplyDeleteCtx func(ctx context.Context, key string) error
+
+// NotifyCtx after a write is done, receives the context of the request
+type NotifyCtx func(ctx context.Context, key string)
+
+// Next passes the data on to the next filter of the chain,
+// past the end of the chain the data is returned as is
+type Next func(data []byte) ([]byte, error)
+
+// ApplyChain filter function of a chain, next runs the following filter that matches the key.
+// The filters of a key run from the most specific path: exact keys, then narrower globs, then broader ones,
+// filters of the same precedence run in the order they were added
+type ApplyChain func(ctx context.Context, key string, data []byte, next Next) ([]byte, error)
+
+// NextDelete runs the next delete filter of the chain
+type NextDelete func() error
+
+// ApplyDeleteChain delete filter function of a chain, next runs the following filter that matches the key
+type ApplyDeleteChain func(ctx context.Context, key string, next NextDelete) error
+
 type hook struct {
 	path  string
-	apply ApplyDelete
+	apply ApplyDeleteChain
 }
 
 // Filter path -> match
 type filter struct {
 	path  string
-	apply Apply
+	apply ApplyChain
 }
 
 type watch struct {
 	path  string
-	apply Notify
+	apply NotifyCtx
 }
 
 // Router group of filters
@@ -54,6 +83,20 @@ type filters struct {
 
 // DeleteFilter add a filter that runs before sending a read result
 func (app *Server) DeleteFilter(path string, apply ApplyDelete) {
+	app.DeleteFilterCtx(path, func(_ context.Context, key string) error {
+		return apply(key)
+	})
+}
+
+// DeleteFilterCtx add a delete filter that receives the context of the request
+func (app *Server) DeleteFilterCtx(path string, apply ApplyDeleteCtx) {
+	app.DeleteFilterChain(path, func(ctx context.Context, key string, _ NextDelete) error {
+		return apply(ctx, key)
+	})
+}
+
+// DeleteFilterChain add a delete filter that can pass on to the next filter of the key
+func (app *Server) DeleteFilterChain(path string, apply ApplyDeleteChain) {
 	app.filters.Delete = append(app.filters.Delete, hook{
 		path:  path,
 		apply: apply,
@@ -64,6 +107,16 @@ func (app *Server) DeleteFilter(path string, apply ApplyDelete) {
 
 // WriteFilter add a filter that triggers on write
 func (app *Server) WriteFilter(path string, apply Apply) {
+	app.WriteFilterCtx(path, applyCtx(apply))
+}
+
+// WriteFilterCtx add a write filter that receives the context of the request
+func (app *Server) WriteFilterCtx(path string, apply ApplyCtx) {
+	app.WriteFilterChain(path, applyChain(apply))
+}
+
+// WriteFilterChain add a write filter that can pass the data on to the next filter of the key
+func (app *Server) WriteFilterChain(path string, apply ApplyChain) {
 	app.filters.Write = append(app.filters.Write, filter{
 		path:  path,
 		apply: apply,
@@ -72,6 +125,13 @@ func (app *Server) WriteFilter(path string, apply Apply) {
 
 // AfterFilter add a filter that triggers after a successful write
 func (app *Server) AfterFilter(path string, apply Notify) {
+	app.AfterFilterCtx(path, func(_ context.Context, key string) {
+		apply(key)
+	})
+}
+
+// AfterFilterCtx add an after write filter that receives the context of the request
+func (app *Server) AfterFilterCtx(path string, apply NotifyCtx) {
 	app.filters.After = append(app.filters.After, watch{
 		path:  path,
 		apply: apply,
@@ -80,12 +140,38 @@ func (app *Server) AfterFilter(path string, apply Notify) {
 
 // ReadFilter add a filter that runs before sending a read result
 func (app *Server) ReadFilter(path string, apply Apply) {
+	app.ReadFilterCtx(path, applyCtx(apply))
+}
+
+// ReadFilterCtx add a read filter that receives the context of the request,
+// the data of subscriptions and broadcasts is filtered with the context of the pool: the identity and the
+// subscribe request that opened it, without a request for callers that have no identity
+func (app *Server) ReadFilterCtx(path string, apply ApplyCtx) {
+	app.ReadFilterChain(path, applyChain(apply))
+}
+
+// ReadFilterChain add a read filter that can pass the data on to the next filter of the key
+func (app *Server) ReadFilterChain(path string, apply ApplyChain) {
 	app.filters.Read = append(app.filters.Read, filter{
 		path:  path,
 		apply: apply,
 	})
 }
 
+// applyCtx adapts a filter that doesn't use the context
+func applyCtx(apply Apply) ApplyCtx {
+	return func(_ context.Context, key string, data []byte) ([]byte, error) {
+		return apply(key, data)
+	}
+}
+
+// applyChain adapts a filter that ends the chain
+func applyChain(apply ApplyCtx) ApplyChain {
+	return func(ctx context.Context, key string, data []byte, _ Next) ([]byte, error) {
+		return apply(ctx, key, data)
+	}
+}
+
 // NoopHook open noop hook
 func NoopHook(index string) error {
 	return nil
@@ -103,78 +189,104 @@ func (app *Server) OpenFilter(name string) {
 	app.DeleteFilter(name, NoopHook)
 }
 
-func (r watchers) check(path string) {
-	match := -1
-	for i, filter := range r {
-		if filter.path == path || key.Match(filter.path, path) {
-			match = i
-			break
-		}
+// precedes orders the paths of a chain, exact keys before narrower globs before broader ones
+func precedes(a string, b string) bool {
+	globsA := strings.Count(a, "*")
+	globsB := strings.Count(b, "*")
+	if globsA != globsB {
+		return globsA < globsB
 	}
+	return len(a)-globsA > len(b)-globsB
+}
 
-	if match == -1 {
-		return
+// matching filters of a key in order of precedence
+func matching[F any](filters []F, pathOf func(F) string, path string) []F {
+	matched := []F{}
+	for _, f := range filters {
+		if pathOf(f) == path || key.Match(pathOf(f), path) {
+			matched = append(matched, f)
+		}
 	}
+	sort.SliceStable(matched, func(i, j int) bool {
+		return precedes(pathOf(matched[i]), pathOf(matched[j]))
+	})
+	return matched
+}
 
-	r[match].apply(path)
+func errStatic(path string) error {
+	return fmt.Errorf("%w, static mode, key:%s", ErrRouteNotDefined, path)
 }
 
-func (r hooks) check(path string, static bool) error {
-	match := -1
-	for i, filter := range r {
-		if filter.path == path || key.Match(filter.path, path) {
-			match = i
-			break
-		}
+// check runs the most specific after filter of the key
+func (r watchers) check(ctx context.Context, path string) {
+	chain := matching(r, func(w watch) string { return w.path }, path)
+	if len(chain) == 0 {
+		return
 	}
+	chain[0].apply(ctx, path)
+}
 
-	if match == -1 && !static {
-		return nil
+func (r hooks) check(ctx context.Context, path string, static bool) error {
+	chain := matching(r, func(h hook) string { return h.path }, path)
+	if len(chain) == 0 && static {
+		return errStatic(path)
 	}
 
-	if match == -1 && static {
-		return errors.New("route not defined, static mode, key:" + path)
+	err := runHooks(ctx, chain, path)
+	if err != nil {
+		return withCode(ErrFiltered, err)
 	}
+	return nil
+}
 
-	return r[match].apply(path)
+// runHooks calls the first hook of a chain, next calls the rest
+func runHooks(ctx context.Context, chain hooks, path string) error {
+	if len(chain) == 0 {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return withCode(ErrUnavailable, ctx.Err())
+	}
+	return chain[0].apply(ctx, path, func() error {
+		return runHooks(ctx, chain[1:], path)
+	})
 }
 
 func (r router) checkStatic(path string, static bool) error {
-	match := -1
-	for i, filter := range r {
+	if !static {
+		return nil
+	}
+	for _, filter := range r {
 		if filter.path == path || key.Match(filter.path, path) {
-			match = i
-			break
+			return nil
 		}
 	}
+	return errStatic(path)
+}
 
-	if match == -1 && !static {
-		return nil
+func (r router) check(ctx context.Context, path string, data []byte, static bool) ([]byte, error) {
+	chain := matching(r, func(f filter) string { return f.path }, path)
+	if len(chain) == 0 && static {
+		return nil, errStatic(path)
 	}
 
-	if match == -1 && static {
-		return errors.New("route not defined, static mode, key:" + path)
+	filtered, err := runFilters(ctx, chain, path, data)
+	if err != nil {
+		return nil, withCode(ErrFiltered, err)
 	}
-
-	return nil
+	return filtered, nil
 }
 
-func (r router) check(path string, data []byte, static bool) ([]byte, error) {
-	match := -1
-	for i, filter := range r {
-		if filter.path == path || key.Match(filter.path, path) {
-			match = i
-			break
-		}
-	}
-
-	if match == -1 && !static {
+// runFilters calls the first filter of a chain, next passes the data to the rest,
+// the chain stops once the request is canceled or past its deadline
+func runFilters(ctx context.Context, chain router, path string, data []byte) ([]byte, error) {
+	if len(chain) == 0 {
 		return data, nil
 	}
-
-	if match == -1 && static {
-		return nil, errors.New("route not defined, static mode, key:" + path)
+	if ctx.Err() != nil {
+		return nil, withCode(ErrUnavailable, ctx.Err())
 	}
-
-	return r[match].apply(path, data)
+	return chain[0].apply(ctx, path, data, func(next []byte) ([]byte, error) {
+		return runFilters(ctx, chain[1:], path, next)
+	})
 }
@@ -2,6 +2,7 @@ package katamari
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net/http/httptest"
@@ -43,31 +44,31 @@ func TestFilters(t *testing.T) {
 
 	app.Start("localhost:9889")
 	defer app.Close(os.Interrupt)
-	_, err := app.filters.Write.check("test/1", []byte("notest"), false)
+	_, err := app.filters.Write.check(context.Background(), "test/1", []byte("notest"), false)
 	require.Error(t, err)
-	_, err = app.filters.Write.check("test/1", []byte("test"), false)
+	_, err = app.filters.Write.check(context.Background(), "test/1", []byte("test"), false)
 	require.NoError(t, err)
-	data, err := app.filters.Read.check("bag/1", []byte("test"), false)
+	data, err := app.filters.Read.check(context.Background(), "bag/1", []byte("test"), false)
 	require.NoError(t, err)
 	require.Equal(t, "intercepted:bag/1", string(data))
-	_, err = app.filters.Write.check("test1", []byte("test1"), false)
+	_, err = app.filters.Write.check(context.Background(), "test1", []byte("test1"), false)
 	require.NoError(t, err)
 	// test static
-	_, err = app.filters.Write.check("book", []byte("testbook"), true)
+	_, err = app.filters.Write.check(context.Background(), "book", []byte("testbook"), true)
 	require.Error(t, err)
-	_, err = app.filters.Write.check("book/1/1", []byte("testbook"), true)
+	_, err = app.filters.Write.check(context.Background(), "book/1/1", []byte("testbook"), true)
 	require.Error(t, err)
-	_, err = app.filters.Write.check("book/1/1/1", []byte("testbook"), true)
+	_, err = app.filters.Write.check(context.Background(), "book/1/1/1", []byte("testbook"), true)
 	require.Error(t, err)
-	_, err = app.filters.Read.check("book", []byte("testbook"), true)
+	_, err = app.filters.Read.check(context.Background(), "book", []byte("testbook"), true)
 	require.Error(t, err)
-	_, err = app.filters.Read.check("book/1/1", []byte("testbook"), true)
+	_, err = app.filters.Read.check(context.Background(), "book/1/1", []byte("testbook"), true)
 	require.Error(t, err)
-	_, err = app.filters.Read.check("book/1/1/1", []byte("testbook"), true)
+	_, err = app.filters.Read.check(context.Background(), "book/1/1/1", []byte("testbook"), true)
 	require.Error(t, err)
-	_, err = app.filters.Write.check("book/1", []byte("test1"), true)
+	_, err = app.filters.Write.check(context.Background(), "book/1", []byte("test1"), true)
 	require.NoError(t, err)
-	_, err = app.filters.Read.check("book/1", []byte("test1"), true)
+	_, err = app.filters.Read.check(context.Background(), "book/1", []byte("test1"), true)
 	require.NoError(t, err)
 	var jsonStr = []byte(`{"data":"` + messages.Encode([]byte("notest")) + `"}`)
 	req := httptest.NewRequest("POST", "/test/1", bytes.NewBuffer(jsonStr))
@@ -91,3 +92,91 @@ func TestFilters(t *testing.T) {
 	require.Equal(t, 200, resp.StatusCode)
 	require.Equal(t, "intercepted:bag/1", string(body))
 }
+
+func TestFilterPrecedence(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	// registered from the broadest to the most specific
+	app.WriteFilter("*/*", func(key string, data []byte) ([]byte, error) {
+		return []byte("broad"), nil
+	})
+	app.WriteFilter("books/*", func(key string, data []byte) ([]byte, error) {
+		return []byte("glob"), nil
+	})
+	app.WriteFilter("books/1", func(key string, data []byte) ([]byte, error) {
+		return []byte("exact"), nil
+	})
+	ctx := context.Background()
+
+	data, err := app.filters.Write.check(ctx, "books/1", []byte("data"), false)
+	require.NoError(t, err)
+	require.Equal(t, "exact", string(data))
+	data, err = app.filters.Write.check(ctx, "books/2", []byte("data"), false)
+	require.NoError(t, err)
+	require.Equal(t, "glob", string(data))
+	data, err = app.filters.Write.check(ctx, "games/1", []byte("data"), false)
+	require.NoError(t, err)
+	require.Equal(t, "broad", string(data))
+
+	require.True(t, precedes("books/1", "books/*"))
+	require.True(t, precedes("books/fantasy/*", "books/*/*"))
+	require.True(t, precedes("books/*/*", "*/*/*"))
+	require.False(t, precedes("books/*", "books/*"))
+}
+
+func TestFilterChain(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.WriteFilter("*/*", func(key string, data []byte) ([]byte, error) {
+		if !bytes.HasPrefix(data, []byte("valid")) {
+			return nil, errors.New("invalid data")
+		}
+		return append(data, []byte(":validated")...), nil
+	})
+	app.WriteFilterChain("books/*", func(ctx context.Context, key string, data []byte, next Next) ([]byte, error) {
+		return next(append([]byte("valid:"), data...))
+	})
+	app.WriteFilterChain("books/1", func(ctx context.Context, key string, data []byte, next Next) ([]byte, error) {
+		data, err := next(data)
+		if err != nil {
+			return nil, err
+		}
+		return append(data, []byte(":exact")...), nil
+	})
+	app.WriteFilterChain("games/*", func(ctx context.Context, key string, data []byte, next Next) ([]byte, error) {
+		return next(data)
+	})
+	ctx := context.Background()
+
+	data, err := app.filters.Write.check(ctx, "books/1", []byte("one"), false)
+	require.NoError(t, err)
+	require.Equal(t, "valid:one:validated:exact", string(data))
+
+	data, err = app.filters.Write.check(ctx, "books/2", []byte("two"), false)
+	require.NoError(t, err)
+	require.Equal(t, "valid:two:validated", string(data))
+
+	// the generic validation runs under the specific filter
+	_, err = app.filters.Write.check(ctx, "games/1", []byte("one"), false)
+	require.ErrorIs(t, err, ErrFiltered)
+
+	// next past the end of the chain returns the data as is
+	app.ReadFilterChain("notes/*", func(ctx context.Context, key string, data []byte, next Next) ([]byte, error) {
+		return next(append(data, '!'))
+	})
+	data, err = app.filters.Read.check(ctx, "notes/1", []byte("note"), true)
+	require.NoError(t, err)
+	require.Equal(t, "note!", string(data))
+
+	deleted := []string{}
+	app.DeleteFilter("*/*", func(key string) error {
+		deleted = append(deleted, "broad")
+		return nil
+	})
+	app.DeleteFilterChain("books/*", func(ctx context.Context, key string, next NextDelete) error {
+		deleted = append(deleted, "glob")
+		return next()
+	})
+	require.NoError(t, app.filters.Delete.check(ctx, "books/1", false))
+	require.Equal(t, []string{"glob", "broad"}, deleted)
+}
@@ -0,0 +1,84 @@
+package katamari
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// IdempotencyHeader name of the header used to deduplicate publish retries
+const IdempotencyHeader = "Idempotency-Key"
+
+var errIdempotencyPending = withCode(ErrConflict, errors.New("katamari: a request with this idempotency key is in progress"))
+var errIdempotencyMismatch = withCode(ErrConflict, errors.New("katamari: the idempotency key was used with a different body"))
+
+type idempotencyEntry struct {
+	index   string
+	sum     string
+	pending bool
+	expires time.Time
+}
+
+// idempotencyToken scopes an idempotency key to the caller identity and the key of the request
+func idempotencyToken(ctx context.Context, vkey string, header string) string {
+	return fmt.Sprintf("%#v", Identity(ctx)) + ":" + vkey + ":" + header
+}
+
+// idempotency remembers recent idempotency keys and the index they produced
+type idempotency struct {
+	mutex   sync.Mutex
+	entries map[string]idempotencyEntry
+}
+
+// reserve an idempotency key, returns the stored index if the key was already used with the same
+// body digest, a different body is a conflict
+func (id *idempotency) reserve(token string, sum string, window time.Duration) (string, bool, error) {
+	id.mutex.Lock()
+	defer id.mutex.Unlock()
+	now := time.Now()
+	if id.entries == nil {
+		id.entries = map[string]idempotencyEntry{}
+	}
+	entry, found := id.entries[token]
+	if found && now.Before(entry.expires) {
+		if entry.sum != sum {
+			return "", false, errIdempotencyMismatch
+		}
+		if entry.pending {
+			return "", false, errIdempotencyPending
+		}
+		return entry.index, true, nil
+	}
+
+	for k, v := range id.entries {
+		if !now.Before(v.expires) {
+			delete(id.entries, k)
+		}
+	}
+	id.entries[token] = idempotencyEntry{
+		sum:     sum,
+		pending: true,
+		expires: now.Add(window),
+	}
+	return "", false, nil
+}
+
+// commit the index produced by a reserved idempotency key
+func (id *idempotency) commit(token string, sum string, index string, window time.Duration) {
+	id.mutex.Lock()
+	defer id.mutex.Unlock()
+	id.entries[token] = idempotencyEntry{
+		index:   index,
+		sum:     sum,
+		expires: time.Now().Add(window),
+	}
+}
+
+// release a reserved idempotency key after a failed write
+func (id *idempotency) release(token string) {
+	id.mutex.Lock()
+	defer id.mutex.Unlock()
+	delete(id.entries, token)
+}
@@ -0,0 +1,170 @@
+package katamari_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/benitogf/katamari"
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestPostIdempotent(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	var jsonStr = []byte(`{"data":"` + messages.Encode([]byte(`{"one":1}`)) + `"}`)
+
+	req := httptest.NewRequest("POST", "/things/*", bytes.NewBuffer(jsonStr))
+	req.Header.Set(katamari.IdempotencyHeader, "retry1")
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	first, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	req = httptest.NewRequest("POST", "/things/*", bytes.NewBuffer(jsonStr))
+	req.Header.Set(katamari.IdempotencyHeader, "retry1")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	second, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, string(first), string(second))
+
+	raw, err := app.Storage.Get("things/*")
+	require.NoError(t, err)
+	list, err := objects.DecodeList(raw)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(list))
+
+	req = httptest.NewRequest("POST", "/things/*", bytes.NewBuffer(jsonStr))
+	req.Header.Set(katamari.IdempotencyHeader, "retry2")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	raw, err = app.Storage.Get("things/*")
+	require.NoError(t, err)
+	list, err = objects.DecodeList(raw)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(list))
+}
+
+func TestRestPostClientIndex(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	var jsonStr = []byte(`{"data":"` + messages.Encode([]byte(`{"one":1}`)) + `"}`)
+
+	req := httptest.NewRequest("POST", "/things/*?index=abc", bytes.NewBuffer(jsonStr))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, `{"index": "abc"}`, string(body))
+
+	_, err = app.Storage.Get("things/abc")
+	require.NoError(t, err)
+
+	req = httptest.NewRequest("POST", "/things/*?index=abc", bytes.NewBuffer(jsonStr))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	require.Equal(t, http.StatusConflict, resp.StatusCode)
+
+	req = httptest.NewRequest("POST", "/things/*?index=a:b", bytes.NewBuffer(jsonStr))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	req = httptest.NewRequest("POST", "/things/one?index=abc", bytes.NewBuffer(jsonStr))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestRestPostIdempotentScope(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.AuditV2 = func(r *http.Request, operation string, key string) (interface{}, error) {
+		return r.Header.Get("User"), nil
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	post := func(user string, data string) (int, string) {
+		body := []byte(`{"data":"` + messages.Encode([]byte(data)) + `"}`)
+		req := httptest.NewRequest("POST", "/things/*", bytes.NewBuffer(body))
+		req.Header.Set(katamari.IdempotencyHeader, "retry1")
+		req.Header.Set("User", user)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		resp := w.Result()
+		raw, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(raw)
+	}
+
+	status, first := post("ana", `{"one":1}`)
+	require.Equal(t, http.StatusOK, status)
+
+	// the same key with another body is a conflict
+	status, body := post("ana", `{"two":2}`)
+	require.Equal(t, http.StatusConflict, status)
+	require.Contains(t, body, "conflict")
+
+	// another caller doesn't get the index of the first one
+	status, second := post("ben", `{"one":1}`)
+	require.Equal(t, http.StatusOK, status)
+	require.NotEqual(t, first, second)
+
+	status, replay := post("ana", `{"one":1}`)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, first, replay)
+
+	raw, err := app.Storage.Get("things/*")
+	require.NoError(t, err)
+	list, err := objects.DecodeList(raw)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(list))
+}
+
+func TestRestPostIdempotentCors(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	// browsers can send the header on cross domain pushes
+	req, err := http.NewRequest("OPTIONS", "http://"+app.Address+"/things/*", nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", "http://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	// browsers send the request headers in lowercase
+	req.Header.Set("Access-Control-Request-Headers", strings.ToLower(katamari.IdempotencyHeader))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, "*", resp.Header.Get("Access-Control-Allow-Origin"))
+	require.Equal(t, strings.ToLower(katamari.IdempotencyHeader), resp.Header.Get("Access-Control-Allow-Headers"))
+}
@@ -0,0 +1,137 @@
+package katamari
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
+)
+
+// OpClock operation of the clock subscription
+const OpClock = "clock"
+
+// auditV2 identity aware audit function
+// r: the request to be audited
+// operation: OpRead, OpWrite, OpDelete, OpSubscribe or OpClock
+// key: the key of the operation, empty for server routes
+// returns
+// identity: caller identity carried to the filters and subscribe callbacks
+// error: deny the request
+type auditV2 func(r *http.Request, operation string, key string) (interface{}, error)
+
+type identityKey struct{}
+
+// WithIdentity stores the caller identity in a context
+func WithIdentity(ctx context.Context, identity interface{}) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// Identity of the caller stored in a context, nil if there is none
+func Identity(ctx context.Context) interface{} {
+	if ctx == nil {
+		return nil
+	}
+	return ctx.Value(identityKey{})
+}
+
+// identityScope partitions the stream pools by the caller identity, the data of a pool is filtered with a
+// context that carries the identity and the subscribe request that opened the pool, so the subscribers of a pool
+// never receive the view of another caller
+func identityScope(ctx context.Context) (string, context.Context) {
+	identity := Identity(ctx)
+	if identity == nil {
+		return "", context.Background()
+	}
+	poolCtx := WithIdentity(context.Background(), identity)
+	if r := Request(ctx); r != nil {
+		poolCtx = context.WithValue(poolCtx, requestKey{}, r)
+	}
+	return identityName(identity), poolCtx
+}
+
+// identityName stable name of an identity: strings and stringers as they are, the claims of a token without the
+// claims that change on every token, any other identity by its json encoding
+func identityName(identity interface{}) string {
+	switch id := identity.(type) {
+	case string:
+		return id
+	case fmt.Stringer:
+		return id.String()
+	case Claims:
+		stable := Claims{}
+		for name, value := range id {
+			if name != "iat" && name != "exp" && name != "nbf" && name != "jti" {
+				stable[name] = value
+			}
+		}
+		identity = stable
+	}
+	name, err := json.Marshal(identity)
+	if err != nil {
+		return fmt.Sprint(identity)
+	}
+	return string(name)
+}
+
+type requestKey struct{}
+
+// Request of the operation stored in a context: the http request, or the handshake on the subscribe events,
+// on the data of the subscriptions and broadcasts of a caller with an identity it's the subscribe request that opened
+// the pool, nil for callers without an identity since their pools are shared
+func Request(ctx context.Context) *http.Request {
+	if ctx == nil {
+		return nil
+	}
+	r, _ := ctx.Value(requestKey{}).(*http.Request)
+	return r
+}
+
+// Handshake checks if the request stored in a context is a websocket handshake
+func Handshake(ctx context.Context) bool {
+	r := Request(ctx)
+	return r != nil && websocket.IsWebSocketUpgrade(r)
+}
+
+// withCaller stores the identity and then the request in the context of a request,
+// so the request reached through Request(ctx) carries the claims and identity as well
+func withCaller(r *http.Request, identity interface{}) *http.Request {
+	if identity != nil {
+		r = r.WithContext(WithIdentity(r.Context(), identity))
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestKey{}, r))
+}
+
+// authorize a request with the token, Audit, AuditV2 and the access control lists, the returned
+// request carries the request itself, the claims and identity in its context, without AuditV2 the claims or the
+// common name of the client certificate are the identity
+func (app *Server) authorize(r *http.Request, operation string, _key string) (*http.Request, error) {
+	if operation != OpRead && operation != OpSubscribe && reservedKey(_key) {
+		return r, errAuditReadOnly
+	}
+	if (operation == OpWrite || operation == OpDelete) && atomic.LoadInt64(&app.closing) == 1 {
+		return r, errShuttingDown
+	}
+	r, err := app.authenticate(r)
+	if err != nil {
+		return r, err
+	}
+	if !app.Audit(r) {
+		return r, ErrUnauthorized
+	}
+	var identity interface{}
+	if app.AuditV2 != nil {
+		identity, err = app.AuditV2(r, operation, _key)
+		if err != nil {
+			return r, withCode(ErrUnauthorized, err)
+		}
+	} else if claims := TokenClaims(r.Context()); claims != nil {
+		identity = claims
+	} else if cert := ClientCertificate(r); cert != nil {
+		identity = cert.Subject.CommonName
+	}
+	r = withCaller(r, identity)
+	return r, app.checkACL(r.Context(), operation, _key)
+}
@@ -0,0 +1,489 @@
+package katamari
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditV2Identity(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	audited := []string{}
+	seen := map[string]interface{}{}
+	see := func(name string, ctx context.Context) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		seen[name] = Identity(ctx)
+	}
+	unsubscribed := make(chan interface{}, 1)
+
+	app := Server{}
+	app.Silence = true
+	app.AuditV2 = func(r *http.Request, operation string, key string) (interface{}, error) {
+		mutex.Lock()
+		audited = append(audited, operation+" "+key)
+		mutex.Unlock()
+		user := r.Header.Get("User")
+		if user == "" {
+			user = r.URL.Query().Get("user")
+		}
+		if user == "" {
+			return nil, errors.New("missing user")
+		}
+		return user, nil
+	}
+	app.WriteFilterCtx("things/*", func(ctx context.Context, key string, data []byte) ([]byte, error) {
+		see("write", ctx)
+		return data, nil
+	})
+	app.AfterFilterCtx("things/*", func(ctx context.Context, key string) {
+		see("after", ctx)
+	})
+	app.ReadFilterCtx("things/*", func(ctx context.Context, key string, data []byte) ([]byte, error) {
+		see("read", ctx)
+		return data, nil
+	})
+	app.DeleteFilterCtx("things/*", func(ctx context.Context, key string) error {
+		see("delete", ctx)
+		return nil
+	})
+	app.OnSubscribeCtx = func(ctx context.Context, key string) error {
+		see("subscribe", ctx)
+		return nil
+	}
+	app.OnUnsubscribeCtx = func(ctx context.Context, key string) {
+		unsubscribed <- Identity(ctx)
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	body := []byte(`{"data":"` + messages.Encode([]byte(`{"name":"one"}`)) + `"}`)
+	req := httptest.NewRequest("POST", "/things/1", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	req = httptest.NewRequest("POST", "/things/1", bytes.NewBuffer(body))
+	req.Header.Set("User", "ana")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	req = httptest.NewRequest("GET", "/things/1", nil)
+	req.Header.Set("User", "ben")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/things/*", RawQuery: "user=eva"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+	c.Close()
+	select {
+	case identity := <-unsubscribed:
+		require.Equal(t, "eva", identity)
+	case <-time.After(time.Second):
+		t.Fatal("unsubscribe not called")
+	}
+
+	req = httptest.NewRequest("DELETE", "/things/1", nil)
+	req.Header.Set("User", "dan")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Equal(t, "ana", seen["write"])
+	require.Equal(t, "ana", seen["after"])
+	require.Equal(t, "eva", seen["subscribe"])
+	require.Equal(t, "dan", seen["delete"])
+	require.Equal(t, []string{
+		"write things/1",
+		"write things/1",
+		"read things/1",
+		"subscribe things/*",
+		"delete things/1",
+	}, audited)
+}
+
+func TestAuditV2ReadFilterIdentity(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.AuditV2 = func(r *http.Request, operation string, key string) (interface{}, error) {
+		return r.Header.Get("User"), nil
+	}
+	app.ReadFilterCtx("profile", func(ctx context.Context, key string, data []byte) ([]byte, error) {
+		if Identity(ctx) != "owner" {
+			return nil, errors.New("private")
+		}
+		return data, nil
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("profile", messages.Encode([]byte(`{"name":"owner"}`)))
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/profile", nil)
+	req.Header.Set("User", "owner")
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	req = httptest.NewRequest("GET", "/profile", nil)
+	req.Header.Set("User", "guest")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
+
+func TestFilterRequestContext(t *testing.T) {
+	t.Parallel()
+	var mutex sync.Mutex
+	seen := map[string]string{}
+	see := func(name string, value string) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		seen[name] = value
+	}
+	handshake := make(chan bool, 1)
+
+	app := Server{}
+	app.Silence = true
+	app.WriteFilterCtx("things/*", func(ctx context.Context, key string, data []byte) ([]byte, error) {
+		see("write", Request(ctx).Header.Get("X-Tenant"))
+		return data, nil
+	})
+	app.ReadFilterCtx("things/*", func(ctx context.Context, key string, data []byte) ([]byte, error) {
+		r := Request(ctx)
+		if r == nil {
+			// data of a subscription or a broadcast
+			return data, nil
+		}
+		see("read", r.URL.Query().Get("tenant"))
+		return data, nil
+	})
+	app.OnSubscribeCtx = func(ctx context.Context, key string) error {
+		select {
+		case handshake <- Handshake(ctx) && Request(ctx).URL.Query().Get("tenant") == "acme":
+		default:
+		}
+		return nil
+	}
+	app.DeleteFilterCtx("things/*", func(ctx context.Context, key string) error {
+		see("delete", Request(ctx).Method)
+		return nil
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	body := []byte(`{"data":"` + messages.Encode([]byte(`{"name":"one"}`)) + `"}`)
+	req := httptest.NewRequest("POST", "/things/1", bytes.NewBuffer(body))
+	req.Header.Set("X-Tenant", "acme")
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	req = httptest.NewRequest("GET", "/things/1?tenant=acme", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/things/*", RawQuery: "tenant=acme"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	select {
+	case matched := <-handshake:
+		require.True(t, matched)
+	case <-time.After(time.Second):
+		t.Fatal("handshake not received")
+	}
+
+	req = httptest.NewRequest("DELETE", "/things/1", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Equal(t, "acme", seen["write"])
+	require.Equal(t, "acme", seen["read"])
+	require.Equal(t, "DELETE", seen["delete"])
+}
+
+func TestFilterSubscriptionHandshake(t *testing.T) {
+	t.Parallel()
+	seen := make(chan string, 10)
+	app := Server{}
+	app.Silence = true
+	app.AuditV2 = func(r *http.Request, operation string, key string) (interface{}, error) {
+		return r.URL.Query().Get("user"), nil
+	}
+	app.ReadFilterCtx("things/*", func(ctx context.Context, key string, data []byte) ([]byte, error) {
+		if Handshake(ctx) {
+			seen <- Request(ctx).URL.Query().Get("tenant")
+		}
+		return data, nil
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+	tenant := func() string {
+		select {
+		case value := <-seen:
+			return value
+		case <-time.After(time.Second):
+			t.Fatal("handshake not received")
+		}
+		return ""
+	}
+
+	// the first message and the updates are filtered with the handshake that opened the pool
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/things/*", RawQuery: "user=ana&tenant=acme"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, "acme", tenant())
+
+	_, err = app.Storage.Set("things/1", messages.Encode([]byte(`{"name":"one"}`)))
+	require.NoError(t, err)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, "acme", tenant())
+
+	// a second connection of the caller shares the pool and its handshake
+	u.RawQuery = "user=ana&tenant=other"
+	second, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = second.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, "acme", tenant())
+}
+
+func TestFilterRequestIdentity(t *testing.T) {
+	t.Parallel()
+	seen := make(chan interface{}, 1)
+	app := Server{}
+	app.Silence = true
+	app.AuditV2 = func(r *http.Request, operation string, key string) (interface{}, error) {
+		return r.Header.Get("User"), nil
+	}
+	app.WriteFilterCtx("things/*", func(ctx context.Context, key string, data []byte) ([]byte, error) {
+		// the stored request is the authorized one
+		seen <- Identity(Request(ctx).Context())
+		return data, nil
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	body := []byte(`{"data":"` + messages.Encode([]byte(`{"name":"one"}`)) + `"}`)
+	req := httptest.NewRequest("POST", "/things/1", bytes.NewBuffer(body))
+	req.Header.Set("User", "ana")
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "ana", <-seen)
+}
+
+func TestFilterCancellation(t *testing.T) {
+	t.Parallel()
+	canceled := make(chan error, 1)
+	app := Server{}
+	app.Silence = true
+	app.Deadline = 100 * time.Millisecond
+	app.WriteFilterCtx("slow/*", func(ctx context.Context, key string, data []byte) ([]byte, error) {
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return nil, ctx.Err()
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	body := []byte(`{"data":"` + messages.Encode([]byte(`{"name":"one"}`)) + `"}`)
+	req := httptest.NewRequest("POST", "/slow/1", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	select {
+	case err := <-canceled:
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+	case <-time.After(time.Second):
+		t.Fatal("filter not canceled")
+	}
+
+	// a canceled request doesn't reach the rest of the chain
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	called := false
+	app.WriteFilter("late/*", func(key string, data []byte) ([]byte, error) {
+		called = true
+		return data, nil
+	})
+	_, err := app.filters.Write.check(ctx, "late/1", []byte("data"), false)
+	require.ErrorIs(t, err, ErrUnavailable)
+	require.ErrorIs(t, err, context.Canceled)
+	require.False(t, called)
+}
+
+func TestAuditV2SubscriptionIdentity(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.AuditV2 = func(r *http.Request, operation string, key string) (interface{}, error) {
+		return r.URL.Query().Get("user"), nil
+	}
+	// each caller only sees its own notes
+	app.ReadFilterCtx("notes/*", func(ctx context.Context, key string, data []byte) ([]byte, error) {
+		notes, err := objects.DecodeListRaw(data)
+		if err != nil {
+			return nil, err
+		}
+		owned := []objects.Object{}
+		for _, note := range notes {
+			if note.Index == Identity(ctx) {
+				owned = append(owned, note)
+			}
+		}
+		return objects.Encode(owned)
+	})
+	app.WriteFilter("notes/*", NoopFilter)
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	subscribe := func(user string) *websocket.Conn {
+		u := url.URL{Scheme: "ws", Host: app.Address, Path: "/notes/*", RawQuery: "user=" + user}
+		c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+		require.NoError(t, err)
+		return c
+	}
+	read := func(c *websocket.Conn, cache string) (string, []objects.Object) {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, message, err := c.ReadMessage()
+		require.NoError(t, err)
+		cache, notes, err := messages.PatchList(message, cache)
+		require.NoError(t, err)
+		return cache, notes
+	}
+	ana := subscribe("ana")
+	defer ana.Close()
+	anaCache, _ := read(ana, "")
+	ben := subscribe("ben")
+	defer ben.Close()
+	benCache, _ := read(ben, "")
+
+	var anaNotes, benNotes []objects.Object
+	for _, note := range []string{"ana", "ben"} {
+		_, err := app.Storage.Set("notes/"+note, messages.Encode([]byte(`{"text":"`+note+`"}`)))
+		require.NoError(t, err)
+		anaCache, anaNotes = read(ana, anaCache)
+		benCache, benNotes = read(ben, benCache)
+	}
+
+	require.Len(t, anaNotes, 1)
+	require.Equal(t, "ana", anaNotes[0].Index)
+	require.Equal(t, `{"text":"ana"}`, anaNotes[0].Data)
+	require.Len(t, benNotes, 1)
+	require.Equal(t, "ben", benNotes[0].Index)
+	require.Equal(t, `{"text":"ben"}`, benNotes[0].Data)
+	// the clock pool and a pool per identity
+	pools, _ := app.Stream.Count()
+	require.Equal(t, 3, pools)
+
+	// a scoped pool is dropped with its last connection
+	ana.Close()
+	require.Eventually(t, func() bool {
+		pools, _ := app.Stream.Count()
+		return pools == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestAuditV2ReadPools(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.AuditV2 = func(r *http.Request, operation string, key string) (interface{}, error) {
+		return r.Header.Get("User"), nil
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("thing", messages.Encode([]byte(`{"name":"one"}`)))
+	require.NoError(t, err)
+
+	// plain reads use the unscoped pool instead of creating one per identity
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("GET", "/thing", nil)
+		req.Header.Set("User", "user"+strconv.Itoa(i))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	}
+	pools, _ := app.Stream.Count()
+	require.Equal(t, 2, pools)
+}
+
+func TestAuditV2Clock(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Tick = 20 * time.Millisecond
+	app.AuditV2 = func(r *http.Request, operation string, key string) (interface{}, error) {
+		return "ana", nil
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	// the clock is not scoped by the identity
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		c.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err = c.ReadMessage()
+		require.NoError(t, err)
+	}
+	pools, _ := app.Stream.Count()
+	require.Equal(t, 1, pools)
+}
+
+func TestIdentityName(t *testing.T) {
+	type user struct {
+		Name string
+		Team *string
+	}
+	team := "blue"
+	require.Equal(t, "ana", identityName("ana"))
+	require.Equal(t, identityName(&user{Name: "ana", Team: &team}), identityName(&user{Name: "ana", Team: &team}))
+	require.NotEqual(t, identityName(user{Name: "ana"}), identityName(user{Name: "ben"}))
+	// tokens of the same subject share the name
+	require.Equal(t,
+		identityName(Claims{"sub": "ana", "iat": 1, "exp": 2}),
+		identityName(Claims{"sub": "ana", "iat": 3, "exp": 4}))
+	require.NotEqual(t, identityName(Claims{"sub": "ana"}), identityName(Claims{"sub": "ben"}))
+}
@@ -1,12 +1,19 @@
 package io_test
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"runtime"
 	"testing"
 	"time"
 
 	"github.com/benitogf/katamari"
+	"github.com/benitogf/katamari/client"
 	"github.com/benitogf/katamari/io"
 	"github.com/stretchr/testify/require"
 )
@@ -129,3 +136,167 @@ func TestRemoteIO(t *testing.T) {
 	require.Equal(t, "what", things[0].Data.This)
 	require.Equal(t, "this", things[2].Data.This)
 }
+
+func TestRemotePushWithOpt(t *testing.T) {
+	server := &katamari.Server{}
+	server.Silence = true
+	server.Start("localhost:0")
+	defer server.Close(os.Interrupt)
+
+	item := Thing{
+		This: "this",
+		That: "that",
+	}
+	index, err := io.RemotePushWithOpt(server.Client, false, server.Address, THINGS_PATH, item, io.PushOpt{
+		IdempotencyKey: "push1",
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, index)
+
+	retryIndex, err := io.RemotePushWithOpt(server.Client, false, server.Address, THINGS_PATH, item, io.PushOpt{
+		IdempotencyKey: "push1",
+	})
+	require.NoError(t, err)
+	require.Equal(t, index, retryIndex)
+
+	things, err := io.GetList[Thing](server, THINGS_PATH)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(things))
+
+	index, err = io.RemotePushWithOpt(server.Client, false, server.Address, THINGS_PATH, item, io.PushOpt{
+		Index: "custom",
+	})
+	require.NoError(t, err)
+	require.Equal(t, "custom", index)
+
+	_, err = io.RemotePushWithOpt(server.Client, false, server.Address, THINGS_PATH, item, io.PushOpt{
+		Index: "custom",
+	})
+	require.Error(t, err)
+
+	thing, err := io.Get[Thing](server, THINGS_BASE_PATH+"/custom")
+	require.NoError(t, err)
+	require.Equal(t, "this", thing.Data.This)
+}
+
+// writeTestCert writes the certificate of the httptest package, returns the files and a pool that trusts it
+func writeTestCert(t *testing.T) (string, string, *x509.CertPool) {
+	ts := httptest.NewTLSServer(nil)
+	defer ts.Close()
+	keyDer, err := x509.MarshalPKCS8PrivateKey(ts.TLS.Certificates[0].PrivateKey)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0600)
+	require.NoError(t, err)
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(ts.Certificate())
+	return certFile, keyFile, pool
+}
+
+func TestRemoteIOTLS(t *testing.T) {
+	certFile, keyFile, pool := writeTestCert(t)
+	server := &katamari.Server{}
+	server.Silence = true
+	server.StartTLS("localhost:0", certFile, keyFile)
+	defer server.Close(os.Interrupt)
+	tlsClient := io.TLSClient(&tls.Config{RootCAs: pool})
+
+	err := io.RemoteSet(tlsClient, true, server.Address, THING1_PATH, Thing{
+		This: "this",
+		That: "that",
+	})
+	require.NoError(t, err)
+	thing1, err := io.RemoteGet[Thing](tlsClient, true, server.Address, THING1_PATH)
+	require.NoError(t, err)
+	require.Equal(t, "this", thing1.Data.This)
+
+	_, err = io.RemoteGet[Thing](server.Client, true, server.Address, THING1_PATH)
+	require.Error(t, err)
+
+	client.TLSConfig = &tls.Config{RootCAs: pool}
+	defer func() { client.TLSConfig = nil }()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := make(chan client.Meta[Thing], 1)
+	go client.Subscribe(ctx, "wss", server.Address, THING1_PATH, func(things []client.Meta[Thing]) {
+		received <- things[0]
+	})
+	select {
+	case thing := <-received:
+		require.Equal(t, "that", thing.Data.That)
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription over wss not received")
+	}
+}
+
+func TestRemoteIOUnix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "katamari.sock")
+	server := &katamari.Server{}
+	server.Silence = true
+	server.Start(katamari.UnixPrefix + socket)
+	defer server.Close(os.Interrupt)
+	unixClient := io.UnixClient(socket)
+
+	err := io.RemoteSet(unixClient, false, server.Address, THING1_PATH, Thing{
+		This: "this",
+		That: "that",
+	})
+	require.NoError(t, err)
+	thing1, err := io.RemoteGet[Thing](unixClient, false, server.Address, THING1_PATH)
+	require.NoError(t, err)
+	require.Equal(t, "this", thing1.Data.This)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := make(chan client.Meta[Thing], 1)
+	go client.Subscribe(ctx, "ws", server.Address, THING1_PATH, func(things []client.Meta[Thing]) {
+		received <- things[0]
+	})
+	select {
+	case thing := <-received:
+		require.Equal(t, "that", thing.Data.That)
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription over a unix socket not received")
+	}
+}
+
+func TestRemoteIOKeyCharset(t *testing.T) {
+	server := &katamari.Server{}
+	server.Silence = true
+	server.Start("localhost:0")
+	defer server.Close(os.Interrupt)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	received := make(chan []client.Meta[Thing], 2)
+	go client.Subscribe(ctx, "ws", server.Address, "cosas/*", func(things []client.Meta[Thing]) {
+		received <- things
+	})
+	select {
+	case <-received:
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription snapshot not received")
+	}
+
+	err := io.RemoteSet(server.Client, false, server.Address, "cosas/año-2024@acme.io", Thing{
+		This: "ñandú",
+		That: "名前",
+	})
+	require.NoError(t, err)
+	thing, err := io.RemoteGet[Thing](server.Client, false, server.Address, "cosas/año-2024@acme.io")
+	require.NoError(t, err)
+	require.Equal(t, "ñandú", thing.Data.This)
+	require.Equal(t, "año-2024@acme.io", thing.Index)
+
+	select {
+	case things := <-received:
+		require.Len(t, things, 1)
+		require.Equal(t, "名前", things[0].Data.That)
+	case <-time.After(2 * time.Second):
+		t.Fatal("subscription update not received")
+	}
+}
@@ -2,11 +2,16 @@ package io
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"time"
 
 	"github.com/benitogf/katamari/client"
 	"github.com/benitogf/katamari/key"
@@ -18,6 +23,32 @@ type PostBody struct {
 	Data string `json:"data"`
 }
 
+// TLSClient http client for the remote functions with a custom tls configuration,
+// such as a private certificate authority or a client certificate (mTLS)
+func TLSClient(config *tls.Config) *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: config,
+		},
+	}
+}
+
+// UnixClient http client for the remote functions that dials a unix domain socket,
+// use it with a host that has the unix prefix, as in "unix:/run/katamari.sock"
+func UnixClient(socket string) *http.Client {
+	return &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
 func RemoteSet[T any](_client *http.Client, ssl bool, host string, path string, item T) error {
 	lastPath := key.LastIndex(path)
 	isList := lastPath == "*"
@@ -43,10 +74,11 @@ func RemoteSet[T any](_client *http.Client, ssl bool, host string, path string,
 	}
 
 	var resp *http.Response
+	host = client.URLHost(host)
 	if ssl {
-		resp, err = _client.Post("https://"+host+"/"+path, "application/json", bytes.NewReader(jsonPostBodyData))
+		resp, err = _client.Post("https://"+host+"/"+key.Escape(path), "application/json", bytes.NewReader(jsonPostBodyData))
 	} else {
-		resp, err = _client.Post("http://"+host+"/"+path, "application/json", bytes.NewReader(jsonPostBodyData))
+		resp, err = _client.Post("http://"+host+"/"+key.Escape(path), "application/json", bytes.NewReader(jsonPostBodyData))
 	}
 	_ = resp
 	// if err != nil {
@@ -90,14 +122,92 @@ func RemotePush[T any](_client *http.Client, ssl bool, host string, path string,
 		return err
 	}
 
+	host = client.URLHost(host)
 	if ssl {
-		_, err = _client.Post("https://"+host+"/"+_path, "application/json", bytes.NewReader(jsonPostBodyData))
+		_, err = _client.Post("https://"+host+"/"+key.Escape(_path), "application/json", bytes.NewReader(jsonPostBodyData))
 	} else {
-		_, err = _client.Post("http://"+host+"/"+_path, "application/json", bytes.NewReader(jsonPostBodyData))
+		_, err = _client.Post("http://"+host+"/"+key.Escape(_path), "application/json", bytes.NewReader(jsonPostBodyData))
 	}
 	return err
 }
 
+// PushOpt options of a remote push
+//
+// IdempotencyKey: sent as the Idempotency-Key header, retries with the same key return the original index
+//
+// Index: client chosen index for the new item, the server rejects it if it's already in use
+type PushOpt struct {
+	IdempotencyKey string
+	Index          string
+}
+
+type pushResponse struct {
+	Index string `json:"index"`
+}
+
+// RemotePushWithOpt pushes an item to a remote list and returns the index assigned to it
+func RemotePushWithOpt[T any](_client *http.Client, ssl bool, host string, path string, item T, opt PushOpt) (string, error) {
+	lastPath := key.LastIndex(path)
+	isList := lastPath == "*"
+
+	if !isList {
+		return "", errors.New("RemotePushWithOpt[" + path + "]: path is not a list")
+	}
+
+	jsonData, err := json.Marshal(item)
+	if err != nil {
+		log.Println("RemotePushWithOpt["+path+"]: failed to marshal data", err)
+		return "", err
+	}
+	encoded := base64.StdEncoding.EncodeToString(jsonData)
+
+	jsonPostBodyData, err := json.Marshal(PostBody{
+		Data: encoded,
+	})
+	if err != nil {
+		log.Println("RemotePushWithOpt["+path+"]: failed to marshal data", err)
+		return "", err
+	}
+
+	host = client.URLHost(host)
+	scheme := "http://"
+	if ssl {
+		scheme = "https://"
+	}
+	reqURL := scheme + host + "/" + key.Escape(path)
+	if opt.Index != "" {
+		reqURL += "?index=" + url.QueryEscape(opt.Index)
+	}
+	req, err := http.NewRequest("POST", reqURL, bytes.NewReader(jsonPostBodyData))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if opt.IdempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", opt.IdempotencyKey)
+	}
+	resp, err := _client.Do(req)
+	if err != nil {
+		log.Println("RemotePushWithOpt["+path+"]: failed to post to remote", err)
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("RemotePushWithOpt[" + path + "]: " + resp.Status + " " + string(body))
+	}
+	var result pushResponse
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		log.Println("RemotePushWithOpt["+path+"]: failed to decode response", string(body), err)
+		return "", err
+	}
+	return result.Index, nil
+}
+
 func RemoteGet[T any](_client *http.Client, ssl bool, host string, path string) (client.Meta[T], error) {
 	lastPath := key.LastIndex(path)
 	isList := lastPath == "*"
@@ -108,10 +218,11 @@ func RemoteGet[T any](_client *http.Client, ssl bool, host string, path string)
 
 	var resp *http.Response
 	var err error
+	host = client.URLHost(host)
 	if ssl {
-		resp, err = _client.Get("https://" + host + "/" + path)
+		resp, err = _client.Get("https://" + host + "/" + key.Escape(path))
 	} else {
-		resp, err = _client.Get("http://" + host + "/" + path)
+		resp, err = _client.Get("http://" + host + "/" + key.Escape(path))
 	}
 	if err != nil {
 		log.Println("GetFrom["+path+"]: failed to get from remote", err)
@@ -152,10 +263,11 @@ func RemoteGetList[T any](_client *http.Client, ssl bool, host string, path stri
 
 	var resp *http.Response
 	var err error
+	host = client.URLHost(host)
 	if ssl {
-		resp, err = _client.Get("https://" + host + "/" + path)
+		resp, err = _client.Get("https://" + host + "/" + key.Escape(path))
 	} else {
-		resp, err = _client.Get("http://" + host + "/" + path)
+		resp, err = _client.Get("http://" + host + "/" + key.Escape(path))
 	}
 	if err != nil {
 		log.Println("GetListFrom["+path+"]: failed to get from remote", err)
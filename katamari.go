@@ -2,6 +2,8 @@ package katamari
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"log"
 	"net"
 	"net/http"
@@ -23,6 +25,20 @@ import (
 
 const deadlineMsg = "katamari: server deadline reached"
 
+const (
+	// keyRoute path of the key routes, the key is validated by the handlers and
+	// keys starting with "_" are left to the internal routes
+	keyRoute = "/{key:[^_/].*}"
+	// auditRoute path of the audit log reads
+	auditRoute = "/{key:" + AuditPath + "/.+}"
+)
+
+var (
+	errAlreadyActive = errors.New("katamari: server already active")
+	errStartFailed   = errors.New("katamari: server start failed")
+	errShuttingDown  = withCode(ErrUnavailable, errors.New("katamari: the server is shutting down"))
+)
+
 // audit requests function
 // will define approval or denial by the return value
 // r: the request to be audited
@@ -33,7 +49,7 @@ type audit func(r *http.Request) bool
 
 // Server application
 //
-// Router: can be predefined with routes and passed to be extended
+// Router: can be predefined with routes and passed to be extended, it matches the escaped paths (UseEncodedPath)
 //
 // NoBroadcastKeys: array of keys that should not broadcast on changes
 //
@@ -41,6 +57,34 @@ type audit func(r *http.Request) bool
 //
 // Audit: function to audit requests
 //
+// AuditV2: optional function to audit requests by operation and key, the identity it returns
+// is available to the filters and subscribe callbacks through Identity(ctx)
+//
+// Auth: optional token authentication, the claims of the token are available through TokenClaims(ctx)
+// and are the identity when AuditV2 is not defined
+//
+// AuditLog: record every successful publish and unpublish as an entry under _audit/*,
+// the entries can be read and subscribed but not written through the api
+//
+// AuditDigest: add the sha256 digests of the data before and after the change to the audit entries
+//
+// WebhookAttempts: deliveries of a webhook event before it is moved to the dead letters, defaults to 5
+//
+// WebhookBackoff: wait before the first retry of a webhook delivery, doubles on every attempt, defaults to 1 second
+//
+// WebhookTimeout: longest wait for the response of a webhook delivery, defaults to 10 seconds
+//
+// TLSCertFile, TLSKeyFile: certificate and key files of the https server, reloaded when they change
+//
+// TLSClientCAFile: optional file of the certificate authorities that verify client certificates (mTLS),
+// the common name of a verified certificate is the identity when there is no AuditV2 or token
+//
+// TLSConfig: optional base tls configuration of the https server
+//
+// Network: tcp4 (default), tcp6, tcp for dual-stack or unix, an address with the "unix:" prefix is always a unix socket
+//
+// Listener: optional listener created by the caller, takes the place of the address
+//
 // Workers: number of workers to use as readers of the storage->broadcast channel
 //
 // ForcePatch: flag to force patch operations even if the patch is bigger than the snapshot
@@ -49,17 +93,20 @@ type audit func(r *http.Request) bool
 //
 // OnUnsubscribe: function to monitor unsubscribe events
 //
+// OnSubscribeCtx, OnUnsubscribeCtx: optional subscribe callbacks that receive the context of the subscribe request
+//
 // OnClose: function that triggers before closing the application
 //
 // Deadline: time duration of a request before timing out
 //
 // AllowedOrigins: list of allowed origins for cross domain access, defaults to ["*"]
 //
-// AllowedMethods: list of allowed methods for cross domain access, defaults to ["GET", "POST", "DELETE", "PUT"]
+// AllowedMethods: list of allowed methods for cross domain access, defaults to ["GET", "POST", "DELETE", "PUT", "PATCH"]
 //
-// AllowedHeaders: list of allowed headers for cross domain access, defaults to ["Authorization", "Content-Type"]
+// AllowedHeaders: list of allowed headers for cross domain access, defaults to ["Authorization", "Content-Type", "Idempotency-Key",
+// "If-None-Match"]
 //
-// ExposedHeaders: list of exposed headers for cross domain access, defaults to nil
+// ExposedHeaders: list of exposed headers for cross domain access, defaults to ["ETag", "Last-Modified", "Retry-After"]
 //
 // Storage: database interdace implementation
 //
@@ -72,21 +119,47 @@ type audit func(r *http.Request) bool
 // Signal: os signal channel
 //
 // Client: http client to make requests
+//
+// MaxWait: longest wait allowed on a long poll read, defaults to 2 minutes
+//
+// IdempotencyWindow: time to remember an Idempotency-Key on publish, defaults to 5 minutes
+//
+// MaxBodySize: largest request body or websocket message accepted, defaults to 10MB, a negative value removes the limit
+//
+// RateLimitIdentity: function that identifies the client of a rate limited request, defaults to the remote ip
 type Server struct {
-	wg                sync.WaitGroup
+	workers           sync.WaitGroup
+	stopping          context.Context
+	stop              context.CancelFunc
 	server            *http.Server
 	Router            *mux.Router
 	Stream            stream.Stream
 	filters           filters
+	schemas           schemas
 	Pivot             string
 	NoBroadcastKeys   []string
 	DbOpt             interface{}
 	Audit             audit
+	AuditV2           auditV2
+	Auth              *TokenAuth
+	AuditLog          bool
+	AuditDigest       bool
+	WebhookAttempts   int
+	WebhookBackoff    time.Duration
+	WebhookTimeout    time.Duration
+	TLSCertFile       string
+	TLSKeyFile        string
+	TLSClientCAFile   string
+	TLSConfig         *tls.Config
+	Network           string
+	Listener          net.Listener
 	Workers           int
 	ForcePatch        bool
 	NoPatch           bool
 	OnSubscribe       stream.Subscribe
 	OnUnsubscribe     stream.Unsubscribe
+	OnSubscribeCtx    stream.SubscribeCtx
+	OnUnsubscribeCtx  stream.UnsubscribeCtx
 	OnClose           func()
 	Deadline          time.Duration
 	AllowedOrigins    []string
@@ -107,6 +180,18 @@ type Server struct {
 	WriteTimeout      time.Duration
 	ReadHeaderTimeout time.Duration
 	IdleTimeout       time.Duration
+	IdempotencyWindow time.Duration
+	MaxWait           time.Duration
+	MaxBodySize       int64
+	bodyLimits        bodyLimits
+	RateLimitIdentity func(r *http.Request) string
+	rateLimiter       rateLimiter
+	acl               acl
+	webhooks          webhooks
+	indexClock        int64
+	metrics           metrics
+	idempotency       idempotency
+	keyLocks          keyLocks
 }
 
 // tcpKeepAliveListener sets TCP keep-alive timeouts on accepted
@@ -117,14 +202,16 @@ type tcpKeepAliveListener struct {
 	*net.TCPListener
 }
 
-func (app *Server) waitListen() {
-	var err error
-	err = app.Storage.Start(StorageOpt{
-		NoBroadcastKeys: app.NoBroadcastKeys,
-		DbOpt:           app.DbOpt,
-	})
+// serve starts the storage and the listener, requests are served on a goroutine
+func (app *Server) serve() error {
+	err := app.startStorage()
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := app.tlsConfig()
 	if err != nil {
-		log.Fatal(err)
+		app.Storage.Close()
+		return err
 	}
 	app.server = &http.Server{
 		WriteTimeout:      app.WriteTimeout,
@@ -132,25 +219,30 @@ func (app *Server) waitListen() {
 		ReadHeaderTimeout: app.ReadHeaderTimeout,
 		IdleTimeout:       app.IdleTimeout,
 		Addr:              app.Address,
-		Handler: cors.New(cors.Options{
-			AllowedMethods: app.AllowedMethods,
-			AllowedOrigins: app.AllowedOrigins,
-			AllowedHeaders: app.AllowedHeaders,
-			ExposedHeaders: app.ExposedHeaders,
-			// AllowCredentials: true,
-			// Debug:          true,
-		}).Handler(handlers.CompressHandler(app.Router))}
-	ln, err := net.Listen("tcp4", app.Address)
+		Handler:           app.handler(),
+		TLSConfig:         tlsConfig,
+	}
+	app.server.RegisterOnShutdown(app.Stream.CloseEventStreams)
+	ln, err := app.listen()
 	if err != nil {
-		log.Fatal("failed to start tcp, ", err)
+		app.Storage.Close()
+		return err
 	}
-	app.Address = ln.Addr().String()
+	app.Address = listenerAddress(ln)
+	app.Console = coat.NewConsole(app.Address, app.Silence)
 	atomic.StoreInt64(&app.active, 1)
-	app.wg.Done()
-	err = app.server.Serve(tcpKeepAliveListener{ln.(*net.TCPListener)})
-	if atomic.LoadInt64(&app.closing) != 1 {
-		log.Fatal(err)
-	}
+	go func(server *http.Server, console *coat.Console) {
+		var err error
+		if tlsConfig != nil {
+			err = server.ServeTLS(serveListener(ln), "", "")
+		} else {
+			err = server.Serve(serveListener(ln))
+		}
+		if atomic.LoadInt64(&app.closing) != 1 {
+			console.Err("serveError", err)
+		}
+	}(app.server, app.Console)
+	return nil
 }
 
 // Active check if the server is active
@@ -158,35 +250,37 @@ func (app *Server) Active() bool {
 	return atomic.LoadInt64(&app.active) == 1 && atomic.LoadInt64(&app.closing) == 0
 }
 
-func (app *Server) waitStart() {
+func (app *Server) waitStart() error {
 	if atomic.LoadInt64(&app.active) == 0 || !app.Storage.Active() {
-		log.Fatal("server start failed")
+		return errStartFailed
 	}
 
 	for i := 0; i < app.Workers; i++ {
+		app.workers.Add(1)
 		go app.watch(app.Storage.Watch())
 	}
 
 	app.Console.Log("glad to serve[" + app.Address + "]")
+	return nil
 }
 
 // Fetch data, update cache and apply filter
-func (app *Server) fetch(key string) (stream.Cache, error) {
+func (app *Server) fetch(ctx context.Context, key string) (stream.Cache, error) {
 	err := app.filters.Read.checkStatic(key, app.Static)
 	if err != nil {
 		return stream.Cache{}, err
 	}
 
-	return app.Stream.Refresh(key, app.getFilteredData)
+	return app.Stream.RefreshCtx(ctx, key, app.getFilteredData)
 }
 
 // getFilteredData
-func (app *Server) getFilteredData(key string) ([]byte, error) {
+func (app *Server) getFilteredData(ctx context.Context, key string) ([]byte, error) {
 	raw, _ := app.Storage.Get(key)
 	if len(raw) == 0 {
 		raw = objects.EmptyObject
 	}
-	filteredData, err := app.filters.Read.check(key, raw, app.Static)
+	filteredData, err := app.filters.Read.check(ctx, key, raw, app.Static)
 	if err != nil {
 		return []byte(""), err
 	}
@@ -194,15 +288,19 @@ func (app *Server) getFilteredData(key string) ([]byte, error) {
 }
 
 func (app *Server) watch(sc StorageChan) {
+	defer app.workers.Done()
+	// broadcasts are not tied to a request, the data of each pool is filtered with the context of its scope
 	broadcastOpt := stream.BroadcastOpt{
-		Get:      app.getFilteredData,
-		Encode:   messages.Encode,
-		Callback: nil,
+		GetCtx:    app.getFilteredData,
+		GetRawCtx: app.getRawFilteredData,
+		Encode:    messages.Encode,
+		Callback:  nil,
 	}
 	for {
 		ev := <-sc
 		if ev.Key != "" {
 			app.Console.Log("broadcast[" + ev.Key + "]")
+			atomic.AddInt64(&app.metrics.broadcasts, 1)
 			app.Stream.Broadcast(ev.Key, broadcastOpt)
 		}
 		if !app.Storage.Active() {
@@ -230,11 +328,15 @@ func (app *Server) defaults() {
 	}
 
 	if len(app.AllowedMethods) == 0 {
-		app.AllowedMethods = []string{"GET", "POST", "DELETE", "PUT"}
+		app.AllowedMethods = []string{"GET", "POST", "DELETE", "PUT", "PATCH"}
 	}
 
 	if len(app.AllowedHeaders) == 0 {
-		app.AllowedHeaders = []string{"Authorization", "Content-Type"}
+		app.AllowedHeaders = []string{"Authorization", "Content-Type", IdempotencyHeader, "If-None-Match"}
+	}
+
+	if len(app.ExposedHeaders) == 0 {
+		app.ExposedHeaders = []string{"ETag", "Last-Modified", "Retry-After"}
 	}
 
 	if app.Console == nil {
@@ -269,6 +371,38 @@ func (app *Server) defaults() {
 		app.IdleTimeout = 10 * time.Second
 	}
 
+	if app.MaxWait == 0 {
+		app.MaxWait = 2 * time.Minute
+	}
+
+	if app.MaxBodySize == 0 {
+		app.MaxBodySize = DefaultMaxBodySize
+	}
+
+	if app.Stream.ReadLimit == nil {
+		app.Stream.ReadLimit = app.wsReadLimit
+	}
+
+	if app.IdempotencyWindow == 0 {
+		app.IdempotencyWindow = 5 * time.Minute
+	}
+
+	if app.WebhookAttempts == 0 {
+		app.WebhookAttempts = DefaultWebhookAttempts
+	}
+
+	if app.WebhookBackoff == 0 {
+		app.WebhookBackoff = DefaultWebhookBackoff
+	}
+
+	if app.WebhookTimeout == 0 {
+		app.WebhookTimeout = DefaultWebhookTimeout
+	}
+
+	if app.RateLimitIdentity == nil {
+		app.RateLimitIdentity = clientAddress
+	}
+
 	if app.Audit == nil {
 		app.Audit = func(r *http.Request) bool { return true }
 	}
@@ -289,6 +423,18 @@ func (app *Server) defaults() {
 		app.Stream.OnUnsubscribe = app.OnUnsubscribe
 	}
 
+	if app.Stream.OnSubscribeCtx == nil {
+		app.Stream.OnSubscribeCtx = app.OnSubscribeCtx
+	}
+
+	if app.Stream.OnUnsubscribeCtx == nil {
+		app.Stream.OnUnsubscribeCtx = app.OnUnsubscribeCtx
+	}
+
+	if app.Stream.Scope == nil {
+		app.Stream.Scope = identityScope
+	}
+
 	if app.Workers == 0 {
 		app.Workers = 6
 	}
@@ -325,42 +471,154 @@ func (app *Server) defaults() {
 
 // Start : initialize and start the http server and database connection
 func (app *Server) Start(address string) {
-	app.Address = address
-	if atomic.LoadInt64(&app.active) == 1 {
+	err := app.StartE(address)
+	if errors.Is(err, errAlreadyActive) {
 		app.Console.Err("server already active")
 		return
 	}
+	if err != nil {
+		log.Fatal("failed to start the server, ", err)
+	}
+}
+
+// StartE : initialize and start the http server and database connection,
+// returns the errors of the storage or the listener instead of exiting
+func (app *Server) StartE(address string) error {
+	err := app.prepare(address)
+	if err != nil {
+		return err
+	}
+	err = app.serve()
+	if err != nil {
+		app.stop()
+		return err
+	}
+	return app.run()
+}
+
+// prepare the defaults, routes and state of a start
+func (app *Server) prepare(address string) error {
+	if atomic.LoadInt64(&app.active) == 1 {
+		return errAlreadyActive
+	}
+	app.Address = address
 	atomic.StoreInt64(&app.active, 0)
 	atomic.StoreInt64(&app.closing, 0)
 	app.defaults()
+	app.routes()
+	app.webhooks.wake = make(chan struct{}, 1)
+	app.webhooks.done = make(chan struct{})
+	app.stopping, app.stop = context.WithCancel(context.Background())
+	return nil
+}
+
+// run the watch workers, the clock and the webhooks dispatcher once the storage is active
+func (app *Server) run() error {
+	err := app.waitStart()
+	if err != nil {
+		app.Shutdown(context.Background())
+		return err
+	}
+	go app.tick()
+	app.serveWebhooks()
+	return nil
+}
+
+// routes of the api
+func (app *Server) routes() {
+	// keys are matched escaped and decoded by the handlers
+	app.Router.UseEncodedPath()
 	// https://ieftimov.com/post/make-resilient-golang-net-http-servers-using-timeouts-deadlines-context-cancellation/
 	app.Router.HandleFunc("/", app.getStats).Methods("GET")
+	app.Router.HandleFunc(OpenAPIPath, app.getOpenAPI).Methods("GET")
+	app.Router.HandleFunc(ExplorerPath, app.getExplorer).Methods("GET")
+	app.Router.HandleFunc(KeysPath, app.getKeys).Methods("GET")
+	app.Router.HandleFunc(HealthPath, app.getHealth).Methods("GET")
+	app.Router.HandleFunc(ReadyPath, app.getReady).Methods("GET")
+	app.Router.HandleFunc(MetricsPath, app.getMetrics).Methods("GET")
+	if app.Auth != nil && app.Auth.Check != nil {
+		app.Router.HandleFunc(TokenPath, app.issueToken).Methods("POST")
+	}
+	app.Router.Handle("/_batch", app.instrument("batch", http.TimeoutHandler(
+		http.HandlerFunc(app.batch), app.Deadline, deadlineMsg))).Methods("POST")
 	// https://www.calhoun.io/why-cant-i-pass-this-function-as-an-http-handler/
-	app.Router.Handle("/{key:[a-zA-Z\\*\\d\\/]+}", http.TimeoutHandler(
-		http.HandlerFunc(app.unpublish), app.Deadline, deadlineMsg)).Methods("DELETE")
-	app.Router.Handle("/{key:[a-zA-Z\\*\\d\\/]+}", http.TimeoutHandler(
-		http.HandlerFunc(app.publish), app.Deadline, deadlineMsg)).Methods("POST")
-	app.Router.HandleFunc("/{key:[a-zA-Z\\*\\d\\/]+}", app.read).Methods("GET")
-	app.Router.HandleFunc("/{key:[a-zA-Z\\*\\d\\/]+}", app.read).Queries("v", "{[\\d]}").Methods("GET")
-	app.wg.Add(1)
-	go app.waitListen()
-	app.wg.Wait()
-	app.waitStart()
-	app.Console = coat.NewConsole(app.Address, app.Silence)
-	go app.tick()
+	app.Router.Handle(keyRoute, app.instrument(OpDelete, http.TimeoutHandler(
+		http.HandlerFunc(app.unpublish), app.Deadline, deadlineMsg))).Methods("DELETE")
+	app.Router.Handle(keyRoute, app.instrument(OpWrite, http.TimeoutHandler(
+		http.HandlerFunc(app.publish), app.Deadline, deadlineMsg))).Methods("POST")
+	app.Router.Handle(keyRoute, app.instrument("patch", http.TimeoutHandler(
+		http.HandlerFunc(app.patch), app.Deadline, deadlineMsg))).Methods("PATCH")
+	app.Router.Handle(keyRoute, app.instrument(OpRead, http.HandlerFunc(app.read))).Methods("GET")
+	if app.AuditLog {
+		app.Router.Handle(auditRoute, app.instrument(OpRead, http.HandlerFunc(app.read))).Methods("GET")
+	}
+	app.Router.Handle(keyRoute, app.instrument(OpRead, http.HandlerFunc(app.read))).Queries("v", "{[\\d]}").Methods("GET")
+}
+
+// handler of the router with cross domain access and compression
+func (app *Server) handler() http.Handler {
+	return cors.New(cors.Options{
+		AllowedMethods: app.AllowedMethods,
+		AllowedOrigins: app.AllowedOrigins,
+		AllowedHeaders: app.AllowedHeaders,
+		ExposedHeaders: app.ExposedHeaders,
+		// AllowCredentials: true,
+		// Debug:          true,
+	}).Handler(handlers.CompressHandler(app.Router))
+}
+
+// startStorage with the storage options of the server
+func (app *Server) startStorage() error {
+	return app.Storage.Start(StorageOpt{
+		NoBroadcastKeys: app.NoBroadcastKeys,
+		DbOpt:           app.DbOpt,
+	})
 }
 
 // Close : shutdown the http server and database connection
 func (app *Server) Close(sig os.Signal) {
-	if atomic.LoadInt64(&app.closing) != 1 {
-		atomic.StoreInt64(&app.closing, 1)
-		atomic.StoreInt64(&app.active, 0)
-		app.Storage.Close()
-		app.OnClose()
-		app.Console.Err("shutdown", sig)
-		if app.server != nil {
-			app.server.Shutdown(context.Background())
-		}
+	if atomic.LoadInt64(&app.closing) == 1 {
+		return
+	}
+	app.Console.Err("shutdown", sig)
+	app.Shutdown(context.Background())
+}
+
+// Shutdown : gracefully stop the server, writes are rejected while the in flight requests finish,
+// the subscriptions receive a close frame and the watch workers drain the storage events.
+// Returns the context error if the deadline is reached before the server is stopped
+func (app *Server) Shutdown(ctx context.Context) error {
+	if !atomic.CompareAndSwapInt64(&app.closing, 0, 1) {
+		return nil
+	}
+	atomic.StoreInt64(&app.active, 0)
+	if app.stop != nil {
+		app.stop()
+	}
+	var err error
+	if app.server != nil {
+		err = app.server.Shutdown(ctx)
+	}
+	app.Stream.CloseConnections()
+	err = errors.Join(err, app.stopWebhooks(ctx))
+	app.Storage.Close()
+	err = errors.Join(err, waitGroup(ctx, &app.workers))
+	app.OnClose()
+	return err
+}
+
+// waitGroup waits for a group or the end of the context
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
@@ -1,23 +1,67 @@
 package key
 
 import (
+	"errors"
+	"net/url"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // GlobRegex checks for valid glob paths
-var GlobRegex = regexp.MustCompile(`^[a-zA-Z\*\d]$|^[a-zA-Z\*\d][a-zA-Z\*\d\/]+[a-zA-Z\*\d]$`)
+//
+// a key is a list of segments separated by "/", segments hold unicode letters, digits and marks,
+// the symbols "-", "_", ".", "~", "@", "+" and the "*" glob
+var GlobRegex = regexp.MustCompile(`^[\p{L}\p{N}\p{M}\-_.~@+*]+(/[\p{L}\p{N}\p{M}\-_.~@+*]+)*$`)
+
+// ErrInvalidEscape an escaped key that doesn't decode to a valid key
+var ErrInvalidEscape = errors.New("key: invalid escaped key")
 
 // IsValid checks that the key pattern issuported
+//
+// keys starting with "_" are reserved, "." and ".." segments are not allowed
 func IsValid(key string) bool {
-	if strings.Contains(key, "//") || strings.Contains(key, "**") {
+	if strings.Contains(key, "**") || strings.HasPrefix(key, "_") || !utf8.ValidString(key) {
+		return false
+	}
+	if !GlobRegex.MatchString(key) {
 		return false
 	}
+	for _, segment := range strings.Split(key, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// Escape a key for a url path, the segments are percent-encoded and the globs are kept
+func Escape(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = strings.ReplaceAll(url.PathEscape(segment), "%2A", "*")
+	}
+	return strings.Join(segments, "/")
+}
 
-	return GlobRegex.MatchString(key)
+// Unescape a percent-encoded key, segments that decode to a "/" are rejected
+func Unescape(escaped string) (string, error) {
+	segments := strings.Split(escaped, "/")
+	for i, segment := range segments {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil || strings.Contains(decoded, "/") {
+			return "", ErrInvalidEscape
+		}
+		segments[i] = decoded
+	}
+	key := strings.Join(segments, "/")
+	if !IsValid(key) {
+		return "", ErrInvalidEscape
+	}
+	return key, nil
 }
 
 // Match checks if a key is part of a path (glob)
@@ -1,7 +1,12 @@
 package key
 
 import (
+	"math/rand"
+	"net/url"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/quick"
 
 	"github.com/stretchr/testify/require"
 )
@@ -35,3 +40,92 @@ func TestKeyMatch(t *testing.T) {
 	require.False(t, Match("thing/1", "thing/123"))
 	require.False(t, Match("thing/123/*", "thing/123/123/123"))
 }
+
+func TestKeyIsValidCharset(t *testing.T) {
+	require.True(t, IsValid("ab"))
+	require.True(t, IsValid("users/0b9f4c1e-7a3d-4c55-9d4e-2f7e1a6b8c90"))
+	require.True(t, IsValid("mail/jane.doe+news@example.com"))
+	require.True(t, IsValid("snake_case/v1.2~rc"))
+	require.True(t, IsValid("usuarios/josé/*"))
+	require.True(t, IsValid("名前/データ"))
+	require.False(t, IsValid("_audit/1"))
+	require.False(t, IsValid("a/./b"))
+	require.False(t, IsValid("a/../b"))
+	require.False(t, IsValid("a b"))
+	require.False(t, IsValid("a%20b"))
+	require.False(t, IsValid("a?b"))
+	require.False(t, IsValid("a[b]"))
+	require.False(t, IsValid("a\\b"))
+	require.False(t, IsValid("a:b"))
+	require.False(t, IsValid(""))
+	require.False(t, IsValid("a\xffb"))
+}
+
+func TestKeyEscape(t *testing.T) {
+	require.Equal(t, "usuarios/jos%C3%A9/*", Escape("usuarios/josé/*"))
+	require.Equal(t, "mail/jane.doe+news@example.com", Escape("mail/jane.doe+news@example.com"))
+
+	decoded, err := Unescape("usuarios/jos%C3%A9/*")
+	require.NoError(t, err)
+	require.Equal(t, "usuarios/josé/*", decoded)
+
+	_, err = Unescape("a%2Fb")
+	require.ErrorIs(t, err, ErrInvalidEscape)
+	_, err = Unescape("a%zz")
+	require.ErrorIs(t, err, ErrInvalidEscape)
+	_, err = Unescape("a%20b")
+	require.ErrorIs(t, err, ErrInvalidEscape)
+}
+
+// validKey a random key of the documented character set
+type validKey string
+
+var keyRunes = []rune("abcXYZ019-_.~@+áéñüçßøæ名前データключ")
+
+func (validKey) Generate(r *rand.Rand, size int) reflect.Value {
+	segments := make([]string, 1+r.Intn(4))
+	for i := range segments {
+		for {
+			runes := make([]rune, 1+r.Intn(8))
+			for j := range runes {
+				runes[j] = keyRunes[r.Intn(len(keyRunes))]
+			}
+			segment := string(runes)
+			if segment != "." && segment != ".." && (i > 0 || runes[0] != '_') {
+				segments[i] = segment
+				break
+			}
+		}
+	}
+	return reflect.ValueOf(validKey(strings.Join(segments, "/")))
+}
+
+func TestKeyProperties(t *testing.T) {
+	escapeRoundTrip := func(k validKey) bool {
+		decoded, err := Unescape(Escape(string(k)))
+		return IsValid(string(k)) && err == nil && decoded == string(k)
+	}
+	require.NoError(t, quick.Check(escapeRoundTrip, nil))
+
+	// the escaped form is plain ascii that a url keeps as is
+	escapedURL := func(k validKey) bool {
+		escaped := Escape(string(k))
+		u, err := url.Parse("http://localhost/" + escaped)
+		return err == nil && u.EscapedPath() == "/"+escaped && u.Path == "/"+string(k)
+	}
+	require.NoError(t, quick.Check(escapedURL, nil))
+
+	globMatch := func(k validKey) bool {
+		segments := strings.Split(string(k), "/")
+		segments[len(segments)-1] = "*"
+		glob := strings.Join(segments, "/")
+		return Match(string(k), string(k)) && Match(glob, string(k)) &&
+			!Match(glob, string(k)+"/extra") && IsValid(glob)
+	}
+	require.NoError(t, quick.Check(globMatch, nil))
+
+	built := func(k validKey) bool {
+		return IsValid(Build(string(k)+"/*")) && Match(string(k)+"/*", Build(string(k)+"/*"))
+	}
+	require.NoError(t, quick.Check(built, nil))
+}
@@ -0,0 +1,176 @@
+package katamari
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/benitogf/katamari/key"
+	"github.com/benitogf/katamari/objects"
+	"github.com/goccy/go-json"
+)
+
+// KeysPath route of the key browser
+const KeysPath = "/_keys"
+
+var errInvalidLimit = withCode(ErrInvalidData, errors.New("katamari: limitError limit is not valid"))
+
+const (
+	// DefaultKeysLimit page size of a key listing that doesn't define one
+	DefaultKeysLimit = 100
+	// MaxKeysLimit largest page size of a key listing
+	MaxKeysLimit = 1000
+)
+
+// KeysOpt options of a key listing
+//
+// Prefix: only list keys that start with the prefix
+//
+// Glob: only list keys that match the glob pattern
+//
+// Cursor: list keys after the cursor, use the Next value of the previous page
+//
+// Limit: size of the page
+type KeysOpt struct {
+	Prefix string
+	Glob   string
+	Cursor string
+	Limit  int
+}
+
+// KeyInfo metadata of a key
+type KeyInfo struct {
+	Key         string `json:"key"`
+	Created     int64  `json:"created"`
+	Updated     int64  `json:"updated"`
+	Size        int    `json:"size"`
+	Subscribers int    `json:"subscribers"`
+}
+
+// KeysPage a page of a key listing, Next is empty on the last page
+type KeysPage struct {
+	Keys []KeyInfo `json:"keys"`
+	Next string    `json:"next,omitempty"`
+}
+
+// KeyLister storages that can list keys with metadata without the Keys+Get fallback
+type KeyLister interface {
+	KeysInfo(opt KeysOpt) (KeysPage, error)
+}
+
+// KeysInfo lists a page of keys with metadata, storages that don't implement
+// KeyLister are listed with Keys and a Get of every key in the page
+func KeysInfo(db Database, opt KeysOpt) (KeysPage, error) {
+	if lister, ok := db.(KeyLister); ok {
+		return lister.KeysInfo(opt)
+	}
+
+	raw, err := db.Keys()
+	if err != nil {
+		return KeysPage{}, err
+	}
+	var stats Stats
+	err = json.Unmarshal(raw, &stats)
+	if err != nil {
+		return KeysPage{}, err
+	}
+
+	keys, next := pageKeys(stats.Keys, opt)
+	page := KeysPage{Keys: []KeyInfo{}, Next: next}
+	for _, k := range keys {
+		data, err := db.Get(k)
+		if err != nil {
+			continue
+		}
+		page.Keys = append(page.Keys, keyInfo(k, data))
+	}
+	return page, nil
+}
+
+// pageKeys sorts and filters keys, returns the page and the cursor of the next one,
+// the reserved keys are never listed
+func pageKeys(keys []string, opt KeysOpt) ([]string, string) {
+	limit := opt.Limit
+	if limit <= 0 {
+		limit = DefaultKeysLimit
+	}
+	limit = min(limit, MaxKeysLimit)
+
+	sort.Strings(keys)
+	page := []string{}
+	for _, k := range keys {
+		if k <= opt.Cursor || !strings.HasPrefix(k, opt.Prefix) || reservedKey(k) {
+			continue
+		}
+		if opt.Glob != "" && !key.Match(opt.Glob, k) {
+			continue
+		}
+		if len(page) == limit {
+			return page, page[limit-1]
+		}
+		page = append(page, k)
+	}
+	return page, ""
+}
+
+// keyInfo metadata of a stored object
+func keyInfo(k string, data []byte) KeyInfo {
+	info := KeyInfo{Key: k, Size: len(data)}
+	obj, err := objects.DecodeRaw(data)
+	if err == nil {
+		info.Created = obj.Created
+		info.Updated = obj.Updated
+	}
+	return info
+}
+
+func (app *Server) getKeys(w http.ResponseWriter, r *http.Request) {
+	r, err := app.authorize(r, OpRead, "")
+	if err != nil {
+		writeError(w, "", err)
+		return
+	}
+
+	opt := KeysOpt{
+		Prefix: r.FormValue("prefix"),
+		Glob:   r.FormValue("glob"),
+		Cursor: r.FormValue("cursor"),
+	}
+	if opt.Glob != "" && !key.IsValid(opt.Glob) {
+		writeError(w, opt.Glob, ErrInvalidKey)
+		return
+	}
+	if r.FormValue("limit") != "" {
+		limit, err := strconv.Atoi(r.FormValue("limit"))
+		if err != nil || limit <= 0 {
+			writeError(w, "", errInvalidLimit)
+			return
+		}
+		opt.Limit = limit
+	}
+
+	page, err := KeysInfo(app.Storage, opt)
+	if err != nil {
+		writeError(w, "", withCode(ErrInternal, err))
+		return
+	}
+	visible := []KeyInfo{}
+	for _, info := range page.Keys {
+		if !app.readable(r.Context(), info.Key) {
+			continue
+		}
+		info.Subscribers = app.Stream.Subscribers(info.Key)
+		visible = append(visible, info)
+	}
+	page.Keys = visible
+
+	response, err := objects.Encode(page)
+	if err != nil {
+		writeError(w, "", withCode(ErrInternal, err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(response)
+}
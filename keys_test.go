@@ -0,0 +1,107 @@
+package katamari
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// plainStorage hides the KeyLister implementation of the wrapped storage
+type plainStorage struct {
+	Database
+}
+
+func testKeysInfo(t *testing.T, db Database) {
+	app := Server{}
+	app.Silence = true
+	app.Storage = db
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	for i := range 5 {
+		_, err := db.Set("books/"+strconv.Itoa(i), messages.Encode([]byte(`{"n":`+strconv.Itoa(i)+`}`)))
+		require.NoError(t, err)
+	}
+	_, err := db.Set("books/0/notes", messages.Encode([]byte(`{}`)))
+	require.NoError(t, err)
+	_, err = db.Set("shelf", messages.Encode([]byte(`{}`)))
+	require.NoError(t, err)
+
+	page, err := KeysInfo(db, KeysOpt{Prefix: "books/", Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(page.Keys))
+	require.Equal(t, "books/0", page.Keys[0].Key)
+	require.Equal(t, "books/0/notes", page.Keys[1].Key)
+	require.Equal(t, "books/0/notes", page.Next)
+	require.NotZero(t, page.Keys[0].Created)
+	require.NotZero(t, page.Keys[0].Size)
+
+	page, err = KeysInfo(db, KeysOpt{Glob: "books/*", Cursor: "books/2", Limit: 2})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(page.Keys))
+	require.Equal(t, "books/3", page.Keys[0].Key)
+	require.Equal(t, "books/4", page.Keys[1].Key)
+	require.Equal(t, "", page.Next)
+
+	page, err = KeysInfo(db, KeysOpt{})
+	require.NoError(t, err)
+	require.Equal(t, 7, len(page.Keys))
+}
+
+func TestKeysInfoMemory(t *testing.T) {
+	t.Parallel()
+	testKeysInfo(t, &MemoryStorage{})
+}
+
+func TestKeysInfoFallback(t *testing.T) {
+	t.Parallel()
+	testKeysInfo(t, plainStorage{&MemoryStorage{}})
+}
+
+func TestKeysRoute(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("books/1", messages.Encode([]byte(`{"title":"one"}`)))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("books/2", messages.Encode([]byte(`{"title":"two"}`)))
+	require.NoError(t, err)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/books/*"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", KeysPath+"?glob=books/*&limit=1", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var page KeysPage
+	err = json.NewDecoder(resp.Body).Decode(&page)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(page.Keys))
+	require.Equal(t, "books/1", page.Keys[0].Key)
+	require.Equal(t, 1, page.Keys[0].Subscribers)
+	require.Equal(t, "books/1", page.Next)
+
+	req = httptest.NewRequest("GET", KeysPath+"?limit=none", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+}
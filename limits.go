@@ -0,0 +1,68 @@
+package katamari
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"github.com/benitogf/katamari/key"
+)
+
+// DefaultMaxBodySize body size limit used when the server doesn't define one
+const DefaultMaxBodySize int64 = 10 << 20
+
+// bodyLimit size override of a path
+type bodyLimit struct {
+	path string
+	size int64
+}
+
+type bodyLimits []bodyLimit
+
+// BodyLimit overrides the largest request body accepted on a path (glob),
+// a negative size removes the limit on the path
+func (app *Server) BodyLimit(path string, size int64) {
+	app.bodyLimits = append(app.bodyLimits, bodyLimit{
+		path: path,
+		size: size,
+	})
+}
+
+// bodyLimit of a key, the most specific path that matches overrides MaxBodySize
+func (app *Server) bodyLimit(_key string) int64 {
+	best := -1
+	for i, limit := range app.bodyLimits {
+		if (limit.path == _key || key.Match(limit.path, _key)) &&
+			(best == -1 || precedes(limit.path, app.bodyLimits[best].path)) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return app.MaxBodySize
+	}
+	return app.bodyLimits[best].size
+}
+
+// limitBody caps the request body before it is read, responds 413 if the declared length is over the limit
+func limitBody(w http.ResponseWriter, r *http.Request, _key string, limit int64) bool {
+	if limit <= 0 {
+		return true
+	}
+	if r.ContentLength > limit {
+		writeError(w, _key, ErrTooLarge)
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	return true
+}
+
+// readBody of a limited request, the json decoders don't surface the limit error
+func readBody(r *http.Request) (*bytes.Reader, error) {
+	body, err := io.ReadAll(r.Body)
+	return bytes.NewReader(body), err
+}
+
+// wsReadLimit of a key, gorilla treats zero as no limit
+func (app *Server) wsReadLimit(_key string) int64 {
+	return max(app.bodyLimit(_key), 0)
+}
@@ -0,0 +1,150 @@
+package katamari
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+// chunked hides the length of a body so the limit is enforced while reading
+type chunked struct {
+	io.Reader
+}
+
+func TestBodyLimits(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.MaxBodySize = 64
+	app.BodyLimit("big/*", 1024)
+	app.BodyLimit("free/*", -1)
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	payload := func(size int) []byte {
+		return []byte(`{"data":"` + messages.Encode([]byte(`"`+strings.Repeat("a", size)+`"`)) + `"}`)
+	}
+
+	var cases = []struct {
+		path   string
+		body   io.Reader
+		status int
+	}{
+		{"/small/1", bytes.NewReader(payload(8)), http.StatusOK},
+		{"/small/1", bytes.NewReader(payload(128)), http.StatusRequestEntityTooLarge},
+		{"/small/1", chunked{bytes.NewReader(payload(128))}, http.StatusRequestEntityTooLarge},
+		{"/big/1", bytes.NewReader(payload(128)), http.StatusOK},
+		{"/big/1", bytes.NewReader(payload(2048)), http.StatusRequestEntityTooLarge},
+		{"/free/1", bytes.NewReader(payload(4096)), http.StatusOK},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("POST", c.path, c.body)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		resp := w.Result()
+		require.Equal(t, c.status, resp.StatusCode, c.path)
+		if c.status == http.StatusRequestEntityTooLarge {
+			var body ErrorResponse
+			err := json.NewDecoder(resp.Body).Decode(&body)
+			require.NoError(t, err)
+			require.Equal(t, "too_large", body.Code)
+		}
+	}
+
+	_, err := app.Storage.Set("small/2", messages.Encode([]byte(`{"name":"one"}`)))
+	require.NoError(t, err)
+	req := httptest.NewRequest("PATCH", "/small/2", bytes.NewBufferString(`{"name":"`+strings.Repeat("b", 128)+`"}`))
+	req.Header.Set("Content-Type", MergePatchType)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Result().StatusCode)
+
+	batch := `[{"method":"POST","key":"small/*","data":"` + messages.Encode([]byte(strings.Repeat("c", 64))) + `"}]`
+	req = httptest.NewRequest("POST", "/_batch", bytes.NewBufferString(batch))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusRequestEntityTooLarge, w.Result().StatusCode)
+}
+
+func TestBodyLimitBatchOperation(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.BodyLimit("small/*", 16)
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	batch := `[{"method":"POST","key":"small/*","data":"` + messages.Encode([]byte(strings.Repeat("c", 64))) + `"},` +
+		`{"method":"POST","key":"other/*","data":"` + messages.Encode([]byte(`"ok"`)) + `"}]`
+	req := httptest.NewRequest("POST", "/_batch", bytes.NewBufferString(batch))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var results []BatchResult
+	err := json.NewDecoder(resp.Body).Decode(&results)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusRequestEntityTooLarge, results[0].Status)
+	require.Equal(t, "too_large", results[0].Code)
+	require.Equal(t, http.StatusOK, results[1].Status)
+}
+
+func TestBodyLimitWebSocket(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.MaxBodySize = 32
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/thing"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+
+	err = c.WriteMessage(websocket.TextMessage, []byte(strings.Repeat("d", 64)))
+	require.NoError(t, err)
+	_, _, err = c.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), err)
+}
+
+func TestBodyLimitPrecedence(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.MaxBodySize = 64
+	// a narrow override isn't hidden by a broad one defined before
+	app.BodyLimit("*/*", 128)
+	app.BodyLimit("big/*", 1024)
+	app.BodyLimit("big/one", 2048)
+	app.BodyLimit("big/*", 4096)
+	require.Equal(t, int64(128), app.bodyLimit("small/1"))
+	require.Equal(t, int64(1024), app.bodyLimit("big/2"))
+	require.Equal(t, int64(2048), app.bodyLimit("big/one"))
+	require.Equal(t, int64(64), app.bodyLimit("small"))
+
+	// the rate limits and schemas use the same precedence
+	app.RateLimit("*/*", OpWrite, 1, time.Minute)
+	app.RateLimit("things/*", OpWrite, 10, time.Minute)
+	require.Equal(t, 1, app.rateLimiter.find("things/1", OpWrite))
+	require.Equal(t, 0, app.rateLimiter.find("other/1", OpWrite))
+	app.Schema("*/*", json.RawMessage(`{"type":"object"}`))
+	app.Schema("things/*", json.RawMessage(`{"type":"array"}`))
+	require.JSONEq(t, `{"type":"array"}`, string(app.schemas.find("things/*")))
+	require.JSONEq(t, `{"type":"object"}`, string(app.schemas.find("other/*")))
+}
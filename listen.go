@@ -0,0 +1,81 @@
+package katamari
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+)
+
+// UnixPrefix of an address that points to a unix domain socket, as in "unix:/run/katamari.sock"
+const UnixPrefix = "unix:"
+
+var errNetwork = errors.New("katamari: listenError unsupported network")
+
+// listenAddress network and address of a server address, unix addresses carry the socket path
+func listenAddress(network string, address string) (string, string, error) {
+	if strings.HasPrefix(address, UnixPrefix) {
+		return "unix", strings.TrimPrefix(address, UnixPrefix), nil
+	}
+	switch network {
+	case "":
+		return "tcp4", address, nil
+	case "tcp", "tcp4", "tcp6", "unix":
+		return network, address, nil
+	}
+	return "", "", errNetwork
+}
+
+// removeStaleSocket deletes a socket file left behind by a previous run,
+// other kinds of files are kept so the listen fails instead
+func removeStaleSocket(path string) {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	_ = os.Remove(path)
+}
+
+// listen on the address of the server, or use the listener provided by the caller
+func (app *Server) listen() (net.Listener, error) {
+	if app.Listener != nil {
+		return app.Listener, nil
+	}
+	network, address, err := listenAddress(app.Network, app.Address)
+	if err != nil {
+		return nil, err
+	}
+	if network == "unix" {
+		removeStaleSocket(address)
+	}
+	return net.Listen(network, address)
+}
+
+// listenerAddress of a listener, unix sockets keep the prefix so the address can be used by the clients
+func listenerAddress(ln net.Listener) string {
+	if ln.Addr().Network() == "unix" {
+		return UnixPrefix + ln.Addr().String()
+	}
+	return ln.Addr().String()
+}
+
+// serveListener wraps tcp listeners to keep alive the accepted connections
+func serveListener(ln net.Listener) net.Listener {
+	tcp, ok := ln.(*net.TCPListener)
+	if !ok {
+		return ln
+	}
+	return tcpKeepAliveListener{tcp}
+}
+
+// StartListener : initialize and start the http server on a listener created by the caller,
+// for example a systemd activated socket
+func (app *Server) StartListener(ln net.Listener) {
+	app.Listener = ln
+	app.Start(listenerAddress(ln))
+}
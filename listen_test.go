@@ -0,0 +1,122 @@
+package katamari
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func unixHTTPClient(socket string) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", socket)
+			},
+		},
+	}
+}
+
+func TestListenAddress(t *testing.T) {
+	network, address, err := listenAddress("", "localhost:0")
+	require.NoError(t, err)
+	require.Equal(t, "tcp4", network)
+	require.Equal(t, "localhost:0", address)
+
+	network, address, err = listenAddress("tcp", "localhost:0")
+	require.NoError(t, err)
+	require.Equal(t, "tcp", network)
+	require.Equal(t, "localhost:0", address)
+
+	network, address, err = listenAddress("tcp4", "unix:/run/katamari.sock")
+	require.NoError(t, err)
+	require.Equal(t, "unix", network)
+	require.Equal(t, "/run/katamari.sock", address)
+
+	_, _, err = listenAddress("udp", "localhost:0")
+	require.ErrorIs(t, err, errNetwork)
+}
+
+func TestStartUnix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "katamari.sock")
+	// a socket file left behind by a previous run
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	require.NoError(t, err)
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	_, err = os.Stat(socket)
+	require.NoError(t, err)
+
+	app := Server{}
+	app.Silence = true
+	app.Start(UnixPrefix + socket)
+	require.Equal(t, UnixPrefix+socket, app.Address)
+
+	client := unixHTTPClient(socket)
+	resp, err := client.Post("http://localhost/test", "application/json",
+		strings.NewReader(`{"data":"`+messages.Encode([]byte(`{"name":"one"}`))+`"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	dialer := websocket.Dialer{
+		NetDialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socket)
+		},
+	}
+	conn, _, err := dialer.Dial("ws://localhost/test", nil)
+	require.NoError(t, err)
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(message), "snapshot")
+	conn.Close()
+
+	app.Close(os.Interrupt)
+	_, err = os.Stat(socket)
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestStartListener(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	app := Server{}
+	app.Silence = true
+	app.StartListener(ln)
+	defer app.Close(os.Interrupt)
+	require.Equal(t, ln.Addr().String(), app.Address)
+
+	resp, err := http.Get("http://" + app.Address + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
+
+func TestStartTCP6(t *testing.T) {
+	probe, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("ipv6 is not available", err)
+	}
+	probe.Close()
+
+	app := Server{}
+	app.Silence = true
+	app.Network = "tcp6"
+	app.Start("[::1]:0")
+	defer app.Close(os.Interrupt)
+	require.True(t, strings.HasPrefix(app.Address, "[::1]:"))
+
+	resp, err := http.Get("http://" + app.Address + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}
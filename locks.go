@@ -0,0 +1,54 @@
+package katamari
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+)
+
+const lockStripes = 64
+
+// keyLocks striped mutexes to serialize read-modify-write operations on a key
+type keyLocks struct {
+	stripes [lockStripes]sync.Mutex
+}
+
+func stripeOf(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % lockStripes)
+}
+
+// lock the stripe of a key, returns the unlock function
+func (kl *keyLocks) lock(key string) func() {
+	stripe := &kl.stripes[stripeOf(key)]
+	stripe.Lock()
+	return stripe.Unlock
+}
+
+// lockAll the stripes of a group of keys in order, returns the unlock function.
+// A glob can match a key of any stripe so it locks all of them
+func (kl *keyLocks) lockAll(keys []string) func() {
+	var stripes [lockStripes]bool
+	for _, key := range keys {
+		if strings.Contains(key, "*") {
+			for i := range stripes {
+				stripes[i] = true
+			}
+			break
+		}
+		stripes[stripeOf(key)] = true
+	}
+	for i := range stripes {
+		if stripes[i] {
+			kl.stripes[i].Lock()
+		}
+	}
+	return func() {
+		for i := len(stripes) - 1; i >= 0; i-- {
+			if stripes[i] {
+				kl.stripes[i].Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package katamari
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var errInvalidWait = withCode(ErrInvalidData, errors.New("katamari: waitError wait is not a valid duration"))
+
+// longPoll blocks a read until the version of the key differs from the one supplied, the version
+// is the one of the ETag of a GET and the response is the same as the one of a GET
+func (app *Server) longPoll(w http.ResponseWriter, r *http.Request, _key string) {
+	wait, err := time.ParseDuration(r.FormValue("wait"))
+	if err != nil || wait <= 0 {
+		writeError(w, _key, errInvalidWait)
+		return
+	}
+	wait = min(wait, app.MaxWait)
+	version := r.FormValue("v")
+	raw := rawAccept(r)
+
+	entry, err := app.fetch(r.Context(), _key)
+	if err != nil {
+		writeError(w, _key, err)
+		return
+	}
+
+	if version == strconv.FormatInt(entry.Version, 16) {
+		// the wait can outlast the server write timeout
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(wait + app.Deadline))
+		ctx, cancel := context.WithTimeout(r.Context(), wait)
+		if app.stopping != nil {
+			// a shutdown ends the wait
+			defer context.AfterFunc(app.stopping, cancel)()
+		}
+		changed := app.Stream.Wait(ctx, _key, entry.Version)
+		cancel()
+		if !changed {
+			w.Header().Set("ETag", etag(entry.Version, raw))
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		entry, err = app.fetch(r.Context(), _key)
+		if err != nil {
+			writeError(w, _key, err)
+			return
+		}
+	}
+
+	// an empty key still carries its version to wait for the first write
+	w.Header().Set("ETag", etag(entry.Version, raw))
+	app.writeEntry(w, r, _key, entry)
+}
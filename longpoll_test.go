@@ -0,0 +1,103 @@
+package katamari
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/stretchr/testify/require"
+)
+
+func longPollGet(t *testing.T, url string) (*http.Response, string, string) {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	return resp, string(body), strings.Trim(resp.Header.Get("ETag"), "\"")
+}
+
+func TestLongPoll(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("thing", messages.Encode([]byte(`{"name":"one"}`)))
+	require.NoError(t, err)
+
+	// without a matching version the body of a GET is returned right away
+	resp, read, readVersion := longPollGet(t, "http://"+app.Address+"/thing")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, body, version := longPollGet(t, "http://"+app.Address+"/thing?wait=5s")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.Equal(t, read, body)
+	require.Equal(t, readVersion, version)
+	obj, err := objects.Decode([]byte(body))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"one"}`, obj.Data)
+
+	// timeout without changes
+	start := time.Now()
+	resp, _, _ = longPollGet(t, "http://"+app.Address+"/thing?wait=100ms&v="+version)
+	require.Equal(t, http.StatusNotModified, resp.StatusCode)
+	require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+
+	// a write releases the wait
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		app.Storage.Set("thing", messages.Encode([]byte(`{"name":"two"}`)))
+	}()
+	resp, body, next := longPollGet(t, "http://"+app.Address+"/thing?wait=5s&v="+version)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotEqual(t, version, next)
+	obj, err = objects.Decode([]byte(body))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"two"}`, obj.Data)
+
+	// the raw representation is the one of a GET as well
+	req, err := http.NewRequest("GET", "http://"+app.Address+"/thing?wait=5s", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", RawMediaType)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	raw, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, RawMediaType, resp.Header.Get("Content-Type"))
+	require.Contains(t, string(raw), `"two"`)
+
+	resp, _, _ = longPollGet(t, "http://"+app.Address+"/thing?wait=never")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestLongPollEmptyKey(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	// an empty key is not found but carries the version to wait for the first write
+	resp, _, version := longPollGet(t, "http://"+app.Address+"/thing?wait=5s")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	require.NotEmpty(t, version)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		app.Storage.Set("thing", messages.Encode([]byte(`{"name":"one"}`)))
+	}()
+	resp, body, _ := longPollGet(t, "http://"+app.Address+"/thing?wait=5s&v="+version)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	obj, err := objects.Decode([]byte(body))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"one"}`, obj.Data)
+}
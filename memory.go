@@ -17,6 +17,8 @@ type MemoryStorage struct {
 	mutex           sync.RWMutex
 	noBroadcastKeys []string
 	watcher         StorageChan
+	watchMutex      sync.RWMutex
+	done            chan struct{}
 	storage         *Storage
 }
 
@@ -34,21 +36,49 @@ func (db *MemoryStorage) Start(storageOpt StorageOpt) error {
 	if db.storage == nil {
 		db.storage = &Storage{}
 	}
+	db.watchMutex.Lock()
 	if db.watcher == nil {
 		db.watcher = make(StorageChan)
+		db.done = make(chan struct{})
 	}
+	db.watchMutex.Unlock()
 	db.noBroadcastKeys = storageOpt.NoBroadcastKeys
 	db.storage.Active = true
 	return nil
 }
 
 // Close the storage client
+//
+// pending events are dropped instead of blocking, the watcher is closed once no event is being sent
 func (db *MemoryStorage) Close() {
 	db.mutex.Lock()
 	defer db.mutex.Unlock()
 	db.storage.Active = false
+	if db.done == nil {
+		return
+	}
+	close(db.done)
+	db.watchMutex.Lock()
+	defer db.watchMutex.Unlock()
 	close(db.watcher)
 	db.watcher = nil
+	db.done = nil
+}
+
+// notify the watcher of an operation, safe to call while the storage is closing
+func (db *MemoryStorage) notify(path string, operation string) {
+	if key.Contains(db.noBroadcastKeys, path) || !db.Active() {
+		return
+	}
+	db.watchMutex.RLock()
+	defer db.watchMutex.RUnlock()
+	if db.watcher == nil {
+		return
+	}
+	select {
+	case db.watcher <- StorageEvent{Key: path, Operation: operation}:
+	case <-db.done:
+	}
 }
 
 // Clear all keys in the storage
@@ -77,6 +107,26 @@ func (db *MemoryStorage) Keys() ([]byte, error) {
 	return objects.Encode(stats)
 }
 
+// KeysInfo list a page of keys with metadata
+func (db *MemoryStorage) KeysInfo(opt KeysOpt) (KeysPage, error) {
+	keys := []string{}
+	db.mem.Range(func(k interface{}, value interface{}) bool {
+		keys = append(keys, k.(string))
+		return true
+	})
+
+	keys, next := pageKeys(keys, opt)
+	page := KeysPage{Keys: []KeyInfo{}, Next: next}
+	for _, k := range keys {
+		data, found := db.mem.Load(k)
+		if !found {
+			continue
+		}
+		page.Keys = append(page.Keys, keyInfo(k, data.([]byte)))
+	}
+	return page, nil
+}
+
 // KeysRange list keys in a path and time range
 func (db *MemoryStorage) KeysRange(path string, from, to int64) ([]string, error) {
 	keys := []string{}
@@ -90,7 +140,7 @@ func (db *MemoryStorage) KeysRange(path string, from, to int64) ([]string, error
 
 	db.mem.Range(func(k interface{}, value interface{}) bool {
 		current := k.(string)
-		if !key.Match(path, current) {
+		if !matchStored(path, current) {
 			return true
 		}
 		paths := strings.Split(current, "/")
@@ -110,7 +160,7 @@ func (db *MemoryStorage) Get(path string) ([]byte, error) {
 	if !strings.Contains(path, "*") {
 		data, found := db.mem.Load(path)
 		if !found {
-			return []byte(""), errors.New("katamari: not found")
+			return []byte(""), ErrNotFound
 		}
 
 		return data.([]byte), nil
@@ -118,7 +168,7 @@ func (db *MemoryStorage) Get(path string) ([]byte, error) {
 
 	res := []objects.Object{}
 	db.mem.Range(func(k interface{}, value interface{}) bool {
-		if !key.Match(path, k.(string)) {
+		if !matchStored(path, k.(string)) {
 			return true
 		}
 
@@ -148,7 +198,7 @@ func (db *MemoryStorage) GetN(path string, limit int) ([]objects.Object, error)
 	}
 
 	db.mem.Range(func(k interface{}, value interface{}) bool {
-		if !key.Match(path, k.(string)) {
+		if !matchStored(path, k.(string)) {
 			return true
 		}
 
@@ -182,12 +232,12 @@ func (db *MemoryStorage) GetNRange(path string, limit int, from, to int64) ([]ob
 	}
 
 	db.mem.Range(func(k interface{}, value interface{}) bool {
-		if !key.Match(path, k.(string)) {
+		if !matchStored(path, k.(string)) {
 			return true
 		}
 
 		current := k.(string)
-		if !key.Match(path, current) {
+		if !matchStored(path, current) {
 			return true
 		}
 		paths := strings.Split(current, "/")
@@ -241,9 +291,7 @@ func (db *MemoryStorage) Set(path string, data string) (string, error) {
 		Data:    data,
 	}))
 
-	if !key.Contains(db.noBroadcastKeys, path) && db.Active() {
-		db.watcher <- StorageEvent{Key: path, Operation: "set"}
-	}
+	db.notify(path, "set")
 	return index, nil
 }
 
@@ -261,9 +309,7 @@ func (db *MemoryStorage) Pivot(path string, data string, created int64, updated
 		return index, nil
 	}
 
-	if !key.Contains(db.noBroadcastKeys, path) && db.Active() {
-		db.watcher <- StorageEvent{Key: path, Operation: "set"}
-	}
+	db.notify(path, "set")
 	return index, nil
 }
 
@@ -272,28 +318,26 @@ func (db *MemoryStorage) Del(path string) error {
 	if !strings.Contains(path, "*") {
 		_, found := db.mem.Load(path)
 		if !found {
-			return errors.New("katamari: not found")
+			return ErrNotFound
 		}
 		db.mem.Delete(path)
-		if !key.Contains(db.noBroadcastKeys, path) && db.Active() {
-			db.watcher <- StorageEvent{Key: path, Operation: "del"}
-		}
+		db.notify(path, "del")
 		return nil
 	}
 
 	db.mem.Range(func(k interface{}, value interface{}) bool {
-		if key.Match(path, k.(string)) {
+		if matchStored(path, k.(string)) {
 			db.mem.Delete(k.(string))
 		}
 		return true
 	})
-	if !key.Contains(db.noBroadcastKeys, path) && db.Active() {
-		db.watcher <- StorageEvent{Key: path, Operation: "del"}
-	}
+	db.notify(path, "del")
 	return nil
 }
 
 // Watch the storage set/del events
 func (db *MemoryStorage) Watch() StorageChan {
+	db.watchMutex.RLock()
+	defer db.watchMutex.RUnlock()
 	return db.watcher
 }
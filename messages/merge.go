@@ -0,0 +1,46 @@
+package messages
+
+import (
+	"github.com/goccy/go-json"
+)
+
+// MergePatch applies a RFC 7396 JSON merge patch to a document
+func MergePatch(doc []byte, patch []byte) ([]byte, error) {
+	var target interface{}
+	if len(doc) > 0 {
+		err := json.Unmarshal(doc, &target)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var merge interface{}
+	err := json.Unmarshal(patch, &merge)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(mergeValue(target, merge))
+}
+
+func mergeValue(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+
+	for k, v := range patchObject {
+		if v == nil {
+			delete(targetObject, k)
+			continue
+		}
+		targetObject[k] = mergeValue(targetObject[k], v)
+	}
+
+	return targetObject
+}
@@ -59,6 +59,32 @@ func DecodeReader(r io.Reader) (Message, error) {
 	return message, nil
 }
 
+// RawMessage with embedded json data
+type RawMessage struct {
+	Data     json.RawMessage `json:"data"`
+	Version  string          `json:"version"`
+	Snapshot bool            `json:"snapshot"`
+}
+
+// DecodeRawReader decodes a reader with embedded json data into a base64 encoded message
+func DecodeRawReader(r io.Reader) (Message, error) {
+	var raw RawMessage
+	decoder := json.NewDecoder(r)
+	err := decoder.Decode(&raw)
+	if err != nil {
+		return Message{}, err
+	}
+	if len(raw.Data) == 0 {
+		return Message{}, errors.New("katamari: empty reader")
+	}
+
+	return Message{
+		Data:     Encode(raw.Data),
+		Version:  raw.Version,
+		Snapshot: raw.Snapshot,
+	}, nil
+}
+
 // Decode a reader into message
 // Deprecated: use DecodeReader instead
 func Decode(r io.Reader) (Message, error) {
@@ -1,3 +1,28 @@
 package messages
 
-// TODO
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMergePatch(t *testing.T) {
+	result, err := MergePatch([]byte(`{"a":"b","c":{"d":"e","f":"g"}}`), []byte(`{"a":"z","c":{"f":null}}`))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"a":"z","c":{"d":"e"}}`, string(result))
+
+	result, err = MergePatch([]byte(`{"a":["b"]}`), []byte(`{"a":"c"}`))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"a":"c"}`, string(result))
+
+	result, err = MergePatch([]byte(`["a"]`), []byte(`{"a":"c"}`))
+	require.NoError(t, err)
+	require.JSONEq(t, `{"a":"c"}`, string(result))
+
+	result, err = MergePatch([]byte(`{"a":"b"}`), []byte(`["c"]`))
+	require.NoError(t, err)
+	require.JSONEq(t, `["c"]`, string(result))
+
+	_, err = MergePatch([]byte(`{"a":"b"}`), []byte(`not json`))
+	require.Error(t, err)
+}
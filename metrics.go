@@ -0,0 +1,242 @@
+package katamari
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goccy/go-json"
+)
+
+const (
+	// HealthPath liveness route
+	HealthPath = "/_health"
+	// ReadyPath readiness route, responds 503 until the server and storage are active
+	ReadyPath = "/_ready"
+	// MetricsPath route of the metrics in the prometheus text format
+	MetricsPath = "/_metrics"
+)
+
+// latencyBuckets upper bounds in seconds of the request duration histogram
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type requestLabel struct {
+	operation string
+	code      int
+}
+
+type histogram struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+// metrics counters of the server
+type metrics struct {
+	mutex      sync.Mutex
+	requests   map[requestLabel]int64
+	latencies  map[string]*histogram
+	broadcasts int64
+}
+
+// observe a finished request, subscriptions are counted without duration
+func (m *metrics) observe(operation string, code int, duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.requests == nil {
+		m.requests = map[requestLabel]int64{}
+		m.latencies = map[string]*histogram{}
+	}
+	m.requests[requestLabel{operation: operation, code: code}]++
+	if operation == OpSubscribe {
+		return
+	}
+
+	h, found := m.latencies[operation]
+	if !found {
+		h = &histogram{counts: make([]int64, len(latencyBuckets))}
+		m.latencies[operation] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// statusRecorder keeps the status code of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.status == 0 {
+		sr.status = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(data []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(data)
+}
+
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack the connection of a websocket upgrade
+func (sr *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("katamari: response does not implement http.Hijacker")
+	}
+	sr.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
+
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+// instrument counts the requests of an operation and their duration,
+// reads that open a subscription are counted as OpSubscribe
+func (app *Server) instrument(operation string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op := operation
+		if op == OpRead && (r.Header.Get("Upgrade") == "websocket" || acceptEventStream(r)) {
+			op = OpSubscribe
+		}
+		recorder := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		handler.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+		app.metrics.observe(op, recorder.status, time.Since(start))
+	})
+}
+
+func writeStatus(w http.ResponseWriter, code int, status string) {
+	body, _ := json.Marshal(map[string]string{"status": status})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+func (app *Server) getHealth(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, http.StatusOK, "ok")
+}
+
+func (app *Server) getReady(w http.ResponseWriter, r *http.Request) {
+	if !app.Active() || !app.Storage.Active() {
+		writeStatus(w, http.StatusServiceUnavailable, "unavailable")
+		return
+	}
+	writeStatus(w, http.StatusOK, "ready")
+}
+
+func (app *Server) getMetrics(w http.ResponseWriter, r *http.Request) {
+	r, err := app.authorize(r, OpRead, "")
+	if err != nil {
+		writeError(w, "", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	app.writeMetrics(w)
+}
+
+// writeMetrics in the prometheus text exposition format
+func (app *Server) writeMetrics(w io.Writer) {
+	app.metrics.mutex.Lock()
+	labels := make([]requestLabel, 0, len(app.metrics.requests))
+	for label := range app.metrics.requests {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].operation != labels[j].operation {
+			return labels[i].operation < labels[j].operation
+		}
+		return labels[i].code < labels[j].code
+	})
+	fmt.Fprintln(w, "# HELP katamari_requests_total Requests by operation and status code.")
+	fmt.Fprintln(w, "# TYPE katamari_requests_total counter")
+	for _, label := range labels {
+		fmt.Fprintf(w, "katamari_requests_total{operation=%q,code=\"%d\"} %d\n",
+			label.operation, label.code, app.metrics.requests[label])
+	}
+
+	operations := make([]string, 0, len(app.metrics.latencies))
+	for operation := range app.metrics.latencies {
+		operations = append(operations, operation)
+	}
+	sort.Strings(operations)
+	fmt.Fprintln(w, "# HELP katamari_request_duration_seconds Duration of the requests by operation.")
+	fmt.Fprintln(w, "# TYPE katamari_request_duration_seconds histogram")
+	for _, operation := range operations {
+		h := app.metrics.latencies[operation]
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(w, "katamari_request_duration_seconds_bucket{operation=%q,le=%q} %d\n",
+				operation, strconv.FormatFloat(bound, 'g', -1, 64), h.counts[i])
+		}
+		fmt.Fprintf(w, "katamari_request_duration_seconds_bucket{operation=%q,le=\"+Inf\"} %d\n", operation, h.count)
+		fmt.Fprintf(w, "katamari_request_duration_seconds_sum{operation=%q} %s\n",
+			operation, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "katamari_request_duration_seconds_count{operation=%q} %d\n", operation, h.count)
+	}
+	app.metrics.mutex.Unlock()
+
+	fmt.Fprintln(w, "# HELP katamari_broadcasts_total Storage events broadcasted to the pools.")
+	fmt.Fprintln(w, "# TYPE katamari_broadcasts_total counter")
+	fmt.Fprintf(w, "katamari_broadcasts_total %d\n", atomic.LoadInt64(&app.metrics.broadcasts))
+
+	pools, connections := app.Stream.Count()
+	fmt.Fprintln(w, "# HELP katamari_pools Subscription pools.")
+	fmt.Fprintln(w, "# TYPE katamari_pools gauge")
+	fmt.Fprintf(w, "katamari_pools %d\n", pools)
+	fmt.Fprintln(w, "# HELP katamari_connections Subscribed connections.")
+	fmt.Fprintln(w, "# TYPE katamari_connections gauge")
+	fmt.Fprintf(w, "katamari_connections %d\n", connections)
+
+	keys, size := app.storageSize()
+	fmt.Fprintln(w, "# HELP katamari_storage_keys Keys in the storage.")
+	fmt.Fprintln(w, "# TYPE katamari_storage_keys gauge")
+	fmt.Fprintf(w, "katamari_storage_keys %d\n", keys)
+	fmt.Fprintln(w, "# HELP katamari_storage_bytes Size of the stored objects.")
+	fmt.Fprintln(w, "# TYPE katamari_storage_bytes gauge")
+	fmt.Fprintf(w, "katamari_storage_bytes %d\n", size)
+}
+
+// storageSize count of keys in the storage and the size of their stored objects
+func (app *Server) storageSize() (int, int) {
+	var stats Stats
+	raw, err := app.Storage.Keys()
+	if err != nil || json.Unmarshal(raw, &stats) != nil {
+		return 0, 0
+	}
+	size := 0
+	for _, k := range stats.Keys {
+		data, err := app.Storage.Get(k)
+		if err == nil {
+			size += len(data)
+		}
+	}
+	return len(stats.Keys), size
+}
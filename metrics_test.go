@@ -0,0 +1,95 @@
+package katamari
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthReady(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Audit = func(r *http.Request) bool { return false }
+	app.Start("localhost:0")
+
+	for _, path := range []string{HealthPath, ReadyPath} {
+		req := httptest.NewRequest("GET", path, nil)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode, path)
+	}
+
+	app.Close(os.Interrupt)
+	req := httptest.NewRequest("GET", ReadyPath, nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+
+	req = httptest.NewRequest("GET", HealthPath, nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/things/*"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+
+	body := []byte(`{"data":"` + messages.Encode([]byte(`{"name":"one"}`)) + `"}`)
+	resp, err := http.Post("http://"+app.Address+"/things/1", "application/json", bytes.NewBuffer(body))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+
+	resp, err = http.Get("http://" + app.Address + "/things/none")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Get("http://" + app.Address + MetricsPath)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	raw, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	metrics := string(raw)
+
+	require.Contains(t, metrics, "# TYPE katamari_requests_total counter\n")
+	require.Contains(t, metrics, `katamari_requests_total{operation="write",code="200"} 1`)
+	require.Contains(t, metrics, `katamari_requests_total{operation="read",code="404"} 1`)
+	require.Contains(t, metrics, `katamari_request_duration_seconds_count{operation="write"} 1`)
+	require.Contains(t, metrics, `katamari_request_duration_seconds_bucket{operation="read",le="+Inf"} 1`)
+	require.NotContains(t, metrics, `katamari_request_duration_seconds_count{operation="subscribe"}`)
+	require.Contains(t, metrics, "katamari_broadcasts_total 1\n")
+	require.Contains(t, metrics, "# TYPE katamari_pools gauge\n")
+	require.Contains(t, metrics, "katamari_connections 1\n")
+	require.NotContains(t, metrics, "katamari_watch_backlog")
+	require.Contains(t, metrics, "katamari_storage_keys 1\n")
+	stored, err := app.Storage.Get("things/1")
+	require.NoError(t, err)
+	require.Contains(t, metrics, "katamari_storage_bytes "+strconv.Itoa(len(stored))+"\n")
+}
@@ -0,0 +1,50 @@
+package katamari
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+// Handler : initialize the database connection and the watch workers without a listener,
+// returns the api handler to be served by an existing http server. Shutdown releases them
+func (app *Server) Handler() (http.Handler, error) {
+	err := app.prepare(app.Address)
+	if err != nil {
+		return nil, err
+	}
+	err = app.startStorage()
+	if err != nil {
+		app.stop()
+		return nil, err
+	}
+	atomic.StoreInt64(&app.active, 1)
+	err = app.run()
+	if err != nil {
+		return nil, err
+	}
+	return app.handler(), nil
+}
+
+// Mount : installs the api handler on a router under a path prefix, as in "/data".
+// The router must not be the Router of the server
+func (app *Server) Mount(router *mux.Router, prefix string) error {
+	handler, err := app.Handler()
+	if err != nil {
+		return err
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	mounted := http.StripPrefix(prefix, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "" {
+			r.URL.Path = "/"
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	if prefix != "" {
+		router.Handle(prefix, mounted)
+	}
+	router.PathPrefix(prefix + "/").Handler(mounted)
+	return nil
+}
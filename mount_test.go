@@ -0,0 +1,129 @@
+package katamari
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMount(t *testing.T) {
+	router := mux.NewRouter()
+	router.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("outer"))
+	})
+	app := Server{}
+	app.Silence = true
+	err := app.Mount(router, "/data/")
+	require.NoError(t, err)
+	require.True(t, app.Active())
+	server := httptest.NewServer(router)
+	defer server.Close()
+	defer app.Shutdown(context.Background())
+
+	resp, err := http.Get(server.URL + "/status")
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, "outer", string(body))
+
+	u, _ := url.Parse(server.URL)
+	c, _, err := websocket.DefaultDialer.Dial("ws://"+u.Host+"/data/things/*", nil)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+
+	data := messages.Encode([]byte(`{"name":"one"}`))
+	resp, err = http.Post(server.URL+"/data/things/1", "application/json", strings.NewReader(`{"data":"`+data+`"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	// the watch workers broadcast the write to the mounted subscription
+	_, message, err := c.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(message), "version")
+
+	resp, err = http.Get(server.URL + "/data/things/1")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), data)
+
+	resp, err = http.Get(server.URL + "/data")
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), "things/1")
+
+	clock, _, err := websocket.DefaultDialer.Dial("ws://"+u.Host+"/data/", nil)
+	require.NoError(t, err)
+	defer clock.Close()
+	clock.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = clock.ReadMessage()
+	require.NoError(t, err)
+
+	require.NoError(t, app.Shutdown(context.Background()))
+	require.False(t, app.Active())
+	_, _, err = c.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+}
+
+func TestMountExplorer(t *testing.T) {
+	router := mux.NewRouter()
+	app := Server{}
+	app.Silence = true
+	app.OpenFilter("things/*")
+	require.NoError(t, app.Mount(router, "/data"))
+	server := httptest.NewServer(router)
+	defer server.Close()
+	defer app.Shutdown(context.Background())
+
+	page, err := url.Parse(server.URL + "/data" + ExplorerPath)
+	require.NoError(t, err)
+	resp, err := http.Get(page.String())
+	require.NoError(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotContains(t, string(body), `fetch("/`)
+
+	// the spec url of the page resolves under the prefix
+	spec, err := url.Parse("." + OpenAPIPath)
+	require.NoError(t, err)
+	require.Contains(t, string(body), `fetch("`+spec.String()+`")`)
+	resp, err = http.Get(page.ResolveReference(spec).String())
+	require.NoError(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), `"/things/{index}"`)
+
+	// and so do the keys
+	item, err := url.Parse("./things/1")
+	require.NoError(t, err)
+	require.Equal(t, "/data/things/1", page.ResolveReference(item).Path)
+}
+
+func TestHandlerAlreadyActive(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	_, err := app.Handler()
+	require.NoError(t, err)
+	defer app.Shutdown(context.Background())
+	_, err = app.Handler()
+	require.ErrorIs(t, err, errAlreadyActive)
+}
@@ -17,6 +17,14 @@ type Object struct {
 	Data    string `json:"data"`
 }
 
+// RawObject : data structure of elements with embedded json data
+type RawObject struct {
+	Created int64           `json:"created"`
+	Updated int64           `json:"updated"`
+	Index   string          `json:"index"`
+	Data    json.RawMessage `json:"data"`
+}
+
 // EmptyObject byte array value
 var EmptyObject = []byte(`{ "created": 0, "updated": 0, "index": "", "data": "e30=" }`)
 
@@ -133,3 +141,56 @@ func New(obj *Object) []byte {
 
 	return dataBytes.Bytes()
 }
+
+// rawData embeds decoded data, values that aren't valid json are embedded as strings
+func rawData(data string) (json.RawMessage, error) {
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	if json.Valid(decoded) {
+		return decoded, nil
+	}
+
+	return json.Marshal(string(decoded))
+}
+
+// ToRaw converts an encoded object or list of objects into their embedded json form
+func ToRaw(data []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		objs, err := DecodeListRaw(trimmed)
+		if err != nil {
+			return nil, err
+		}
+		res := make([]RawObject, len(objs))
+		for i, obj := range objs {
+			embedded, err := rawData(obj.Data)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = RawObject{
+				Created: obj.Created,
+				Updated: obj.Updated,
+				Index:   obj.Index,
+				Data:    embedded,
+			}
+		}
+		return Encode(res)
+	}
+
+	obj, err := DecodeRaw(trimmed)
+	if err != nil {
+		return nil, err
+	}
+	embedded, err := rawData(obj.Data)
+	if err != nil {
+		return nil, err
+	}
+	return Encode(RawObject{
+		Created: obj.Created,
+		Updated: obj.Updated,
+		Index:   obj.Index,
+		Data:    embedded,
+	})
+}
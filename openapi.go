@@ -0,0 +1,545 @@
+package katamari
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/benitogf/katamari/key"
+	"github.com/goccy/go-json"
+)
+
+// OpenAPIPath well-known path of the OpenAPI document
+const OpenAPIPath = "/_openapi.json"
+
+// ExplorerPath path of the OpenAPI explorer page
+const ExplorerPath = "/_explorer"
+
+type schema struct {
+	path   string
+	schema json.RawMessage
+}
+
+type schemas []schema
+
+// Schema attach a json schema to the data of a path, it will be published on the OpenAPI document
+func (app *Server) Schema(path string, jsonSchema json.RawMessage) {
+	app.schemas = append(app.schemas, schema{
+		path:   path,
+		schema: jsonSchema,
+	})
+}
+
+// find the schema of the most specific path that matches, the first defined on a tie
+func (s schemas) find(path string) json.RawMessage {
+	best := -1
+	for i, sc := range s {
+		if (sc.path == path || key.Match(sc.path, path)) && (best == -1 || precedes(sc.path, s[best].path)) {
+			best = i
+		}
+	}
+	if best == -1 {
+		return nil
+	}
+	return s[best].schema
+}
+
+type openAPIOperations struct {
+	read   bool
+	write  bool
+	delete bool
+}
+
+// openAPIPath converts a glob path into an OpenAPI templated path
+func openAPIPath(path string) (string, []interface{}) {
+	parameters := []interface{}{}
+	segments := strings.Split(path, "/")
+	globs := strings.Count(path, "*")
+	n := 0
+	for i, segment := range segments {
+		if segment != "*" {
+			continue
+		}
+		n++
+		name := "index"
+		if globs > 1 {
+			name += strconv.Itoa(n)
+		}
+		segments[i] = "{" + name + "}"
+		parameters = append(parameters, map[string]interface{}{
+			"name":        name,
+			"in":          "path",
+			"required":    true,
+			"description": "item index, use * to address the whole list",
+			"schema":      map[string]interface{}{"type": "string"},
+		})
+	}
+	return "/" + strings.Join(segments, "/"), parameters
+}
+
+func jsonContent(ref string) map[string]interface{} {
+	return map[string]interface{}{
+		"application/json": map[string]interface{}{
+			"schema": map[string]interface{}{"$ref": "#/components/schemas/" + ref},
+		},
+	}
+}
+
+// openAPIQuery string query parameters
+func openAPIQuery(names ...string) []interface{} {
+	parameters := []interface{}{}
+	for _, name := range names {
+		parameters = append(parameters, map[string]interface{}{
+			"name":   name,
+			"in":     "query",
+			"schema": map[string]interface{}{"type": "string"},
+		})
+	}
+	return parameters
+}
+
+func openAPIResponse(description string, ref string) map[string]interface{} {
+	response := map[string]interface{}{"description": description}
+	if ref != "" {
+		response["content"] = jsonContent(ref)
+	}
+	return response
+}
+
+// openAPIItem describes the operations available on a path
+func openAPIItem(path string, ops openAPIOperations, dataSchema json.RawMessage) map[string]interface{} {
+	_, parameters := openAPIPath(path)
+	item := map[string]interface{}{}
+	if len(parameters) > 0 {
+		item["parameters"] = parameters
+	}
+	if dataSchema == nil {
+		dataSchema = json.RawMessage(`{}`)
+	}
+	if ops.read {
+		item["get"] = map[string]interface{}{
+			"summary": "read " + path,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "stored object, or list of objects when the index is a glob",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"oneOf": []interface{}{
+									map[string]interface{}{"$ref": "#/components/schemas/Object"},
+									map[string]interface{}{"$ref": "#/components/schemas/ObjectList"},
+								},
+							},
+						},
+					},
+				},
+				"304": openAPIResponse("not modified", ""),
+				"400": openAPIResponse("filtered or invalid key", "Error"),
+				"404": openAPIResponse("empty key", "Error"),
+			},
+		}
+	}
+	if ops.write {
+		item["post"] = map[string]interface{}{
+			"summary": "create or update " + path,
+			"requestBody": map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": map[string]interface{}{"$ref": "#/components/schemas/PublishBody"},
+					},
+					RawMediaType: map[string]interface{}{
+						"schema": map[string]interface{}{
+							"type":       "object",
+							"required":   []string{"data"},
+							"properties": map[string]interface{}{"data": dataSchema},
+						},
+					},
+				},
+			},
+			"responses": map[string]interface{}{
+				"200": openAPIResponse("stored", "Index"),
+				"400": openAPIResponse("filtered, invalid key or data", "Error"),
+				"409": openAPIResponse("index already in use", "Error"),
+				"413": openAPIResponse("body too large", "Error"),
+			},
+		}
+		item["patch"] = map[string]interface{}{
+			"summary": "partial update of " + path,
+			"requestBody": map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					JSONPatchType:  map[string]interface{}{"schema": map[string]interface{}{"type": "array"}},
+					MergePatchType: map[string]interface{}{"schema": map[string]interface{}{"type": "object"}},
+				},
+			},
+			"responses": map[string]interface{}{
+				"200": openAPIResponse("stored", "Index"),
+				"400": openAPIResponse("filtered or invalid key", "Error"),
+				"404": openAPIResponse("empty key", "Error"),
+				"413": openAPIResponse("body too large", "Error"),
+				"415": openAPIResponse("unsupported patch type", "Error"),
+				"422": openAPIResponse("patch failed", "Error"),
+			},
+		}
+	}
+	if ops.delete {
+		item["delete"] = map[string]interface{}{
+			"summary": "delete " + path,
+			"responses": map[string]interface{}{
+				"204": openAPIResponse("deleted", ""),
+				"400": openAPIResponse("filtered or invalid key", "Error"),
+				"404": openAPIResponse("not found", "Error"),
+			},
+		}
+	}
+	return item
+}
+
+// openAPI generates the OpenAPI document from the filters, schemas and built-in routes
+func (app *Server) openAPI() ([]byte, error) {
+	order := []string{}
+	routes := map[string]*openAPIOperations{}
+	register := func(path string) *openAPIOperations {
+		if _, found := routes[path]; !found {
+			order = append(order, path)
+			routes[path] = &openAPIOperations{}
+		}
+		return routes[path]
+	}
+	for _, f := range app.filters.Read {
+		register(f.path).read = true
+	}
+	for _, f := range app.filters.Write {
+		register(f.path).write = true
+	}
+	for _, f := range app.filters.Delete {
+		register(f.path).delete = true
+	}
+
+	paths := map[string]interface{}{
+		"/": map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "list of keys",
+				"responses": map[string]interface{}{
+					"200": openAPIResponse("keys", "Stats"),
+				},
+			},
+		},
+		KeysPath: map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary":    "page of keys with metadata",
+				"parameters": openAPIQuery("prefix", "glob", "cursor", "limit"),
+				"responses": map[string]interface{}{
+					"200": openAPIResponse("keys", "KeysPage"),
+					"400": openAPIResponse("invalid glob or limit", "Error"),
+				},
+			},
+		},
+		HealthPath: map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "liveness",
+				"responses": map[string]interface{}{
+					"200": openAPIResponse("alive", ""),
+				},
+			},
+		},
+		ReadyPath: map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "readiness of the server and storage",
+				"responses": map[string]interface{}{
+					"200": openAPIResponse("ready", ""),
+					"503": openAPIResponse("unavailable", ""),
+				},
+			},
+		},
+		MetricsPath: map[string]interface{}{
+			"get": map[string]interface{}{
+				"summary": "metrics in the prometheus text format",
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "metrics",
+						"content": map[string]interface{}{
+							"text/plain": map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+						},
+					},
+				},
+			},
+		},
+		"/_batch": map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "run a group of operations, with atomic=1 the writes are all-or-nothing",
+				"parameters": []interface{}{
+					map[string]interface{}{
+						"name":   "atomic",
+						"in":     "query",
+						"schema": map[string]interface{}{"type": "boolean"},
+					},
+				},
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{
+								"type":  "array",
+								"items": map[string]interface{}{"$ref": "#/components/schemas/BatchOperation"},
+							},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": "results of the operations",
+						"content": map[string]interface{}{
+							"application/json": map[string]interface{}{
+								"schema": map[string]interface{}{
+									"type":  "array",
+									"items": map[string]interface{}{"$ref": "#/components/schemas/BatchResult"},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if app.Auth != nil && app.Auth.Check != nil {
+		paths[TokenPath] = map[string]interface{}{
+			"post": map[string]interface{}{
+				"summary": "issue a token for valid credentials",
+				"responses": map[string]interface{}{
+					"200": openAPIResponse("token", "Token"),
+					"401": openAPIResponse("invalid credentials", "Error"),
+				},
+			},
+		}
+	}
+	if !app.Static {
+		item := openAPIItem("{key}", openAPIOperations{read: true, write: true, delete: true}, nil)
+		item["parameters"] = []interface{}{
+			map[string]interface{}{
+				"name":        "key",
+				"in":          "path",
+				"required":    true,
+				"description": "any valid key with percent-encoded segments, a trailing glob addresses a list",
+				"schema":      map[string]interface{}{"type": "string"},
+			},
+		}
+		paths["/{key}"] = item
+	}
+	for _, path := range order {
+		templated, _ := openAPIPath(path)
+		paths[templated] = openAPIItem(path, *routes[path], app.schemas.find(path))
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "katamari",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"Object": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"created": map[string]interface{}{"type": "integer", "format": "int64"},
+						"updated": map[string]interface{}{"type": "integer", "format": "int64"},
+						"index":   map[string]interface{}{"type": "string"},
+						"data":    map[string]interface{}{"type": "string", "format": "byte"},
+					},
+				},
+				"ObjectList": map[string]interface{}{
+					"type":  "array",
+					"items": map[string]interface{}{"$ref": "#/components/schemas/Object"},
+				},
+				"PublishBody": map[string]interface{}{
+					"type":     "object",
+					"required": []string{"data"},
+					"properties": map[string]interface{}{
+						"data": map[string]interface{}{"type": "string", "format": "byte"},
+					},
+				},
+				"Index": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"index": map[string]interface{}{"type": "string"},
+					},
+				},
+				"Stats": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"keys": map[string]interface{}{
+							"type":  "array",
+							"items": map[string]interface{}{"type": "string"},
+						},
+						"limits": map[string]interface{}{
+							"type": "array",
+							"items": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"path":      map[string]interface{}{"type": "string"},
+									"operation": map[string]interface{}{"type": "string"},
+									"client":    map[string]interface{}{"type": "string"},
+									"tokens":    map[string]interface{}{"type": "number"},
+									"throttled": map[string]interface{}{"type": "integer"},
+								},
+							},
+						},
+					},
+				},
+				"BatchOperation": map[string]interface{}{
+					"type":     "object",
+					"required": []string{"method", "key"},
+					"properties": map[string]interface{}{
+						"method": map[string]interface{}{"type": "string", "enum": []string{"GET", "POST", "DELETE"}},
+						"key":    map[string]interface{}{"type": "string"},
+						"data":   map[string]interface{}{},
+					},
+				},
+				"BatchResult": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"status": map[string]interface{}{"type": "integer"},
+						"index":  map[string]interface{}{"type": "string"},
+						"data":   map[string]interface{}{},
+						"code":   map[string]interface{}{"type": "string"},
+						"error":  map[string]interface{}{"type": "string"},
+					},
+				},
+				"KeysPage": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"keys": map[string]interface{}{
+							"type": "array",
+							"items": map[string]interface{}{
+								"type": "object",
+								"properties": map[string]interface{}{
+									"key":         map[string]interface{}{"type": "string"},
+									"created":     map[string]interface{}{"type": "integer"},
+									"updated":     map[string]interface{}{"type": "integer"},
+									"size":        map[string]interface{}{"type": "integer"},
+									"subscribers": map[string]interface{}{"type": "integer"},
+								},
+							},
+						},
+						"next": map[string]interface{}{"type": "string"},
+					},
+				},
+				"Token": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"token":   map[string]interface{}{"type": "string"},
+						"expires": map[string]interface{}{"type": "integer", "format": "int64"},
+					},
+				},
+				"Error": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"code":    map[string]interface{}{"type": "string"},
+						"message": map[string]interface{}{"type": "string"},
+						"key":     map[string]interface{}{"type": "string"},
+					},
+				},
+			},
+		},
+	})
+}
+
+func (app *Server) getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	r, err := app.authorize(r, OpRead, "")
+	if err != nil {
+		writeError(w, "", err)
+		return
+	}
+
+	doc, err := app.openAPI()
+	if err != nil {
+		writeError(w, "", withCode(ErrInternal, err))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(doc)
+}
+
+func (app *Server) getExplorer(w http.ResponseWriter, r *http.Request) {
+	r, err := app.authorize(r, OpRead, "")
+	if err != nil {
+		writeError(w, "", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "%s", explorerPage)
+}
+
+const explorerPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>katamari explorer</title>
+<style>
+body { font-family: monospace; margin: 2em; }
+.op { margin: .3em 0; cursor: pointer; }
+.method { display: inline-block; width: 5em; font-weight: bold; }
+input, textarea { width: 100%; font-family: monospace; }
+pre { background: #eee; padding: 1em; white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>katamari explorer</h1>
+<div id="paths"></div>
+<h2>request</h2>
+<p><select id="method"><option>GET</option><option>POST</option><option>PATCH</option><option>DELETE</option></select></p>
+<p><input id="key" placeholder="key"></p>
+<p><textarea id="body" rows="6" placeholder="json data (sent in raw mode)"></textarea></p>
+<p><button id="send">send</button></p>
+<pre id="result"></pre>
+<script>
+// the urls are relative to the page so the explorer works on a mounted api
+fetch(".` + OpenAPIPath + `").then(function (res) { return res.json() }).then(function (doc) {
+  var paths = document.getElementById("paths");
+  Object.keys(doc.paths).sort().forEach(function (path) {
+    Object.keys(doc.paths[path]).forEach(function (method) {
+      if (method === "parameters") return;
+      var op = document.createElement("div");
+      op.className = "op";
+      op.innerHTML = '<span class="method"></span><span class="path"></span> <i></i>';
+      op.querySelector(".method").textContent = method.toUpperCase();
+      op.querySelector(".path").textContent = path;
+      op.querySelector("i").textContent = doc.paths[path][method].summary || "";
+      op.onclick = function () {
+        document.getElementById("method").value = method.toUpperCase();
+        document.getElementById("key").value = path.replace(/^\//, "").replace(/\{[^}]+\}/g, "*");
+      };
+      paths.appendChild(op);
+    });
+  });
+});
+document.getElementById("send").onclick = function () {
+  var method = document.getElementById("method").value;
+  var key = document.getElementById("key").value;
+  var body = document.getElementById("body").value;
+  var options = { method: method, headers: {} };
+  if (method === "POST") {
+    options.headers["Content-Type"] = "` + RawMediaType + `";
+    options.body = '{"data":' + (body || "{}") + '}';
+  }
+  if (method === "PATCH") {
+    options.headers["Content-Type"] = body.trim()[0] === "[" ? "` + JSONPatchType + `" : "` + MergePatchType + `";
+    options.body = body;
+  }
+  fetch("./" + key.split("/").map(encodeURIComponent).join("/") + (method === "GET" ? "?raw=1" : ""), options).then(function (res) {
+    return res.text().then(function (text) {
+      document.getElementById("result").textContent = res.status + "\n" + text;
+    });
+  });
+};
+</script>
+</body>
+</html>
+`
@@ -0,0 +1,89 @@
+package katamari
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAPI(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Static = true
+	app.OpenFilter("books/*")
+	app.ReadFilter("authors/*/books/*", NoopFilter)
+	app.Schema("books/*", json.RawMessage(`{"type":"object","properties":{"title":{"type":"string"}}}`))
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req := httptest.NewRequest("GET", OpenAPIPath, nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	var doc struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	err = json.Unmarshal(body, &doc)
+	require.NoError(t, err)
+	require.Equal(t, "3.0.3", doc.OpenAPI)
+	require.Contains(t, doc.Paths, "/")
+	require.Contains(t, doc.Paths, "/_batch")
+	require.NotContains(t, doc.Paths, "/{key}")
+
+	books := doc.Paths["/books/{index}"]
+	require.Contains(t, books, "get")
+	require.Contains(t, books, "post")
+	require.Contains(t, books, "delete")
+	require.Contains(t, string(books["post"]), `"title"`)
+
+	authors := doc.Paths["/authors/{index1}/books/{index2}"]
+	require.Contains(t, authors, "get")
+	require.NotContains(t, authors, "post")
+
+	req = httptest.NewRequest("GET", ExplorerPath, nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), OpenAPIPath)
+}
+
+func TestOpenAPIDynamic(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Audit = func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "yes"
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req := httptest.NewRequest("GET", OpenAPIPath, nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	req = httptest.NewRequest("GET", OpenAPIPath, nil)
+	req.Header.Set("Authorization", "yes")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Contains(t, string(body), `"/{key}"`)
+}
@@ -0,0 +1,118 @@
+package katamari
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/benitogf/jsonpatch"
+	"github.com/benitogf/katamari/key"
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/cristalhq/base64"
+)
+
+const (
+	// JSONPatchType content type of RFC 6902 patch requests
+	JSONPatchType = "application/json-patch+json"
+	// MergePatchType content type of RFC 7396 patch requests
+	MergePatchType = "application/merge-patch+json"
+)
+
+// applyPatch applies a json patch or merge patch document to the data
+func applyPatch(contentType string, data []byte, patch []byte) ([]byte, error) {
+	switch contentType {
+	case JSONPatchType:
+		operations, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, err
+		}
+		return operations.Apply(data)
+	case MergePatchType:
+		return messages.MergePatch(data, patch)
+	}
+
+	return nil, errUnsupportedPatch
+}
+
+var errUnsupportedPatch = withCode(ErrUnsupportedMediaType, errors.New("katamari: unsupported patch content type"))
+
+func (app *Server) patch(w http.ResponseWriter, r *http.Request) {
+	_key, err := routeKey(r)
+	if err != nil || !key.IsValid(_key) || strings.Contains(_key, "*") {
+		writeError(w, _key, ErrInvalidKey)
+		return
+	}
+
+	r, err = app.authorize(r, OpWrite, _key)
+	if err != nil {
+		writeError(w, _key, err)
+		return
+	}
+
+	if !app.allowRate(w, r, OpWrite, _key) {
+		return
+	}
+
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != JSONPatchType && contentType != MergePatchType {
+		writeError(w, _key, errUnsupportedPatch)
+		return
+	}
+
+	if !limitBody(w, r, _key, app.bodyLimit(_key)) {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, _key, withCode(ErrInvalidData, err))
+		return
+	}
+
+	unlock := app.keyLocks.lock(_key)
+	raw, err := app.Storage.Get(_key)
+	if err != nil || len(raw) == 0 {
+		unlock()
+		writeError(w, _key, errEmptyKey)
+		return
+	}
+
+	current, err := objects.Decode(raw)
+	if err != nil {
+		unlock()
+		writeError(w, _key, withCode(ErrInternal, err))
+		return
+	}
+
+	patched, err := applyPatch(contentType, []byte(current.Data), body)
+	if err != nil {
+		unlock()
+		app.Console.Err("patchError["+_key+"]", err)
+		writeError(w, _key, withCode(ErrPatchFailed, err))
+		return
+	}
+
+	data, err := app.filters.Write.check(r.Context(), _key, []byte(base64.StdEncoding.EncodeToString(patched)), app.Static)
+	if err != nil {
+		unlock()
+		app.Console.Err("setError["+_key+"]", err)
+		writeError(w, _key, err)
+		return
+	}
+
+	index, err := app.Storage.Set(_key, string(data))
+	version := app.storedVersion(_key)
+	unlock()
+	if err != nil {
+		writeError(w, _key, withCode(ErrInternal, err))
+		return
+	}
+
+	app.Console.Log("patch", _key)
+	app.changed(newChange(r.Context(), OpWrite, _key, base64.StdEncoding.EncodeToString([]byte(current.Data)), string(data)).withVersion(version))
+	app.filters.After.check(r.Context(), _key)
+	writeIndex(w, index)
+}
@@ -0,0 +1,108 @@
+package katamari_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/benitogf/katamari"
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestPatch(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("thing", messages.Encode([]byte(`{"name":"one","count":1,"tags":["a"]}`)))
+	require.NoError(t, err)
+
+	var patch = []byte(`[{"op":"replace","path":"/count","value":2},{"op":"add","path":"/tags/-","value":"b"}]`)
+	req := httptest.NewRequest("PATCH", "/thing", bytes.NewBuffer(patch))
+	req.Header.Set("Content-Type", katamari.JSONPatchType)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	raw, err := app.Storage.Get("thing")
+	require.NoError(t, err)
+	obj, err := objects.Decode(raw)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"one","count":2,"tags":["a","b"]}`, obj.Data)
+
+	var merge = []byte(`{"name":"two","tags":null}`)
+	req = httptest.NewRequest("PATCH", "/thing", bytes.NewBuffer(merge))
+	req.Header.Set("Content-Type", katamari.MergePatchType)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	raw, err = app.Storage.Get("thing")
+	require.NoError(t, err)
+	obj, err = objects.Decode(raw)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"two","count":2}`, obj.Data)
+}
+
+func TestRestPatchErrors(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.WriteFilter("filtered", func(key string, data []byte) ([]byte, error) {
+		return nil, errors.New("filtered")
+	})
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("thing", messages.Encode([]byte(`{"name":"one"}`)))
+	require.NoError(t, err)
+	_, err = app.Storage.Set("filtered", messages.Encode([]byte(`{"name":"one"}`)))
+	require.NoError(t, err)
+
+	var merge = []byte(`{"name":"two"}`)
+	req := httptest.NewRequest("PATCH", "/missing", bytes.NewBuffer(merge))
+	req.Header.Set("Content-Type", katamari.MergePatchType)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+
+	req = httptest.NewRequest("PATCH", "/thing", bytes.NewBuffer(merge))
+	req.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnsupportedMediaType, w.Result().StatusCode)
+
+	req = httptest.NewRequest("PATCH", "/things/*", bytes.NewBuffer(merge))
+	req.Header.Set("Content-Type", katamari.MergePatchType)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	var patch = []byte(`[{"op":"remove","path":"/missing"}]`)
+	req = httptest.NewRequest("PATCH", "/thing", bytes.NewBuffer(patch))
+	req.Header.Set("Content-Type", katamari.JSONPatchType)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnprocessableEntity, w.Result().StatusCode)
+
+	req = httptest.NewRequest("PATCH", "/filtered", bytes.NewBuffer(merge))
+	req.Header.Set("Content-Type", katamari.MergePatchType)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Result().StatusCode)
+
+	raw, err := app.Storage.Get("filtered")
+	require.NoError(t, err)
+	obj, err := objects.Decode(raw)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"one"}`, obj.Data)
+}
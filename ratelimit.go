@@ -0,0 +1,191 @@
+package katamari
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benitogf/katamari/key"
+	"github.com/benitogf/katamari/objects"
+	"github.com/goccy/go-json"
+)
+
+// operations that can be rate limited
+const (
+	OpRead      = "read"
+	OpWrite     = "write"
+	OpDelete    = "delete"
+	OpSubscribe = "subscribe"
+)
+
+// rateLimit token bucket definition of a path and operation
+type rateLimit struct {
+	path      string
+	operation string
+	limit     int
+	interval  time.Duration
+}
+
+// rate of token refill per nanosecond
+func (rl rateLimit) rate() float64 {
+	return float64(rl.limit) / float64(rl.interval)
+}
+
+type bucketKey struct {
+	limit  int
+	client string
+}
+
+type bucket struct {
+	tokens    float64
+	updated   time.Time
+	throttled int64
+}
+
+// rateLimiter buckets of every client on the defined limits
+type rateLimiter struct {
+	mutex   sync.Mutex
+	limits  []rateLimit
+	buckets map[bucketKey]*bucket
+	swept   time.Time
+}
+
+// LimiterStats state of a client bucket
+type LimiterStats struct {
+	Path      string  `json:"path"`
+	Operation string  `json:"operation"`
+	Client    string  `json:"client"`
+	Tokens    float64 `json:"tokens"`
+	Throttled int64   `json:"throttled"`
+}
+
+// RateLimit allows a client up to limit operations on a path (glob) per interval,
+// operation is one of OpRead, OpWrite, OpDelete or OpSubscribe
+func (app *Server) RateLimit(path string, operation string, limit int, interval time.Duration) {
+	app.rateLimiter.mutex.Lock()
+	defer app.rateLimiter.mutex.Unlock()
+	app.rateLimiter.limits = append(app.rateLimiter.limits, rateLimit{
+		path:      path,
+		operation: operation,
+		limit:     limit,
+		interval:  interval,
+	})
+}
+
+// find the most specific limit defined for a key and operation, the first defined on a tie
+func (rl *rateLimiter) find(_key string, operation string) int {
+	best := -1
+	for i, limit := range rl.limits {
+		if limit.operation == operation && (limit.path == _key || key.Match(limit.path, _key)) &&
+			(best == -1 || precedes(limit.path, rl.limits[best].path)) {
+			best = i
+		}
+	}
+	return best
+}
+
+// take a token from the client bucket, returns the wait until a token is available when empty
+func (rl *rateLimiter) take(_key string, operation string, client string, now time.Time) (bool, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	index := rl.find(_key, operation)
+	if index == -1 {
+		return true, 0
+	}
+	limit := rl.limits[index]
+	if rl.buckets == nil {
+		rl.buckets = map[bucketKey]*bucket{}
+	}
+	rl.sweep(now)
+
+	id := bucketKey{limit: index, client: client}
+	b, found := rl.buckets[id]
+	if !found {
+		b = &bucket{tokens: float64(limit.limit), updated: now}
+		rl.buckets[id] = b
+	}
+	b.tokens = math.Min(float64(limit.limit), b.tokens+float64(now.Sub(b.updated))*limit.rate())
+	b.updated = now
+	if b.tokens < 1 {
+		b.throttled++
+		return false, time.Duration(math.Ceil((1 - b.tokens) / limit.rate()))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops buckets that refilled completely, a new bucket starts full
+func (rl *rateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.swept) < time.Minute {
+		return
+	}
+	rl.swept = now
+	for id, b := range rl.buckets {
+		limit := rl.limits[id.limit]
+		if now.Sub(b.updated) >= limit.interval {
+			delete(rl.buckets, id)
+		}
+	}
+}
+
+// stats of the client buckets
+func (rl *rateLimiter) stats(now time.Time) []LimiterStats {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+	result := []LimiterStats{}
+	for id, b := range rl.buckets {
+		limit := rl.limits[id.limit]
+		result = append(result, LimiterStats{
+			Path:      limit.path,
+			Operation: limit.operation,
+			Client:    id.client,
+			Tokens:    math.Min(float64(limit.limit), b.tokens+float64(now.Sub(b.updated))*limit.rate()),
+			Throttled: b.throttled,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Path != result[j].Path {
+			return result[i].Path < result[j].Path
+		}
+		if result[i].Operation != result[j].Operation {
+			return result[i].Operation < result[j].Operation
+		}
+		return result[i].Client < result[j].Client
+	})
+	return result
+}
+
+// withLimiterStats adds the limiter state to the encoded storage stats
+func withLimiterStats(data []byte, limits []LimiterStats) ([]byte, error) {
+	var stats Stats
+	err := json.Unmarshal(data, &stats)
+	if err != nil {
+		return nil, err
+	}
+	stats.Limits = limits
+	return objects.Encode(stats)
+}
+
+// clientAddress identifies a client by the ip of the request
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// allowRate checks the rate limit of an operation, throttled requests get a 429 response
+func (app *Server) allowRate(w http.ResponseWriter, r *http.Request, operation string, _key string) bool {
+	allowed, wait := app.rateLimiter.take(_key, operation, app.RateLimitIdentity(r), time.Now())
+	if allowed {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(int64(math.Ceil(wait.Seconds())), 10))
+	writeError(w, _key, ErrTooManyRequests)
+	return false
+}
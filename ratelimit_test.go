@@ -0,0 +1,160 @@
+package katamari
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiterBucket(t *testing.T) {
+	t.Parallel()
+	limiter := rateLimiter{}
+	limiter.limits = []rateLimit{{path: "things/*", operation: OpRead, limit: 2, interval: time.Second}}
+	now := time.Now()
+
+	allowed, _ := limiter.take("things/1", OpRead, "a", now)
+	require.True(t, allowed)
+	allowed, _ = limiter.take("things/2", OpRead, "a", now)
+	require.True(t, allowed)
+	allowed, wait := limiter.take("things/1", OpRead, "a", now)
+	require.False(t, allowed)
+	require.Equal(t, 500*time.Millisecond, wait)
+
+	// other clients, operations and paths have their own buckets
+	allowed, _ = limiter.take("things/1", OpRead, "b", now)
+	require.True(t, allowed)
+	allowed, _ = limiter.take("things/1", OpWrite, "a", now)
+	require.True(t, allowed)
+	allowed, _ = limiter.take("other", OpRead, "a", now)
+	require.True(t, allowed)
+
+	allowed, _ = limiter.take("things/1", OpRead, "a", now.Add(500*time.Millisecond))
+	require.True(t, allowed)
+
+	stats := limiter.stats(now.Add(500 * time.Millisecond))
+	require.Equal(t, 2, len(stats))
+	require.Equal(t, "a", stats[0].Client)
+	require.Equal(t, int64(1), stats[0].Throttled)
+	require.Equal(t, "b", stats[1].Client)
+	require.Equal(t, float64(2), stats[1].Tokens)
+
+	limiter.sweep(now.Add(2 * time.Minute))
+	require.Equal(t, 0, len(limiter.stats(now)))
+}
+
+func TestRateLimit(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.RateLimit("things/*", OpWrite, 1, time.Minute)
+	app.RateLimit("things/*", OpRead, 1, time.Minute)
+	app.RateLimitIdentity = func(r *http.Request) string {
+		return r.Header.Get("Authorization")
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	publish := func(client string) *http.Response {
+		body := []byte(`{"data":"` + messages.Encode([]byte(`{"name":"one"}`)) + `"}`)
+		req := httptest.NewRequest("POST", "/things/1", bytes.NewBuffer(body))
+		req.Header.Set("Authorization", client)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	require.Equal(t, http.StatusOK, publish("a").StatusCode)
+	resp := publish("a")
+	require.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	require.Equal(t, "60", resp.Header.Get("Retry-After"))
+	var body ErrorResponse
+	err := json.NewDecoder(resp.Body).Decode(&body)
+	require.NoError(t, err)
+	require.Equal(t, "rate_limited", body.Code)
+	require.Equal(t, http.StatusOK, publish("b").StatusCode)
+
+	req := httptest.NewRequest("GET", "/things/1", nil)
+	req.Header.Set("Authorization", "a")
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	batch := `[{"method":"GET","key":"things/1"},{"method":"GET","key":"other"}]`
+	req = httptest.NewRequest("POST", "/_batch", bytes.NewBufferString(batch))
+	req.Header.Set("Authorization", "a")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	var results []BatchResult
+	err = json.NewDecoder(w.Result().Body).Decode(&results)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusTooManyRequests, results[0].Status)
+	require.Equal(t, http.StatusNotFound, results[1].Status)
+
+	req = httptest.NewRequest("GET", "/", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	var stats Stats
+	err = json.NewDecoder(w.Result().Body).Decode(&stats)
+	require.NoError(t, err)
+	require.Equal(t, []string{"things/1"}, stats.Keys)
+	require.Equal(t, 3, len(stats.Limits))
+	require.Equal(t, LimiterStats{Path: "things/*", Operation: OpRead, Client: "a", Tokens: stats.Limits[0].Tokens, Throttled: 1}, stats.Limits[0])
+	require.Equal(t, int64(1), stats.Limits[1].Throttled)
+	require.Equal(t, "b", stats.Limits[2].Client)
+}
+
+func TestRateLimitBatchIdentity(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.AuditV2 = func(r *http.Request, operation string, key string) (interface{}, error) {
+		return r.Header.Get("User"), nil
+	}
+	app.RateLimit("things/*", OpRead, 1, time.Minute)
+	app.RateLimitIdentity = func(r *http.Request) string {
+		user, _ := Identity(r.Context()).(string)
+		return user
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	// each caller of a batch takes from its own bucket
+	read := func(user string) int {
+		req := httptest.NewRequest("POST", "/_batch", bytes.NewBufferString(`[{"method":"GET","key":"things/1"}]`))
+		req.Header.Set("User", user)
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		var results []BatchResult
+		err := json.NewDecoder(w.Result().Body).Decode(&results)
+		require.NoError(t, err)
+		return results[0].Status
+	}
+	require.Equal(t, http.StatusNotFound, read("ana"))
+	require.Equal(t, http.StatusTooManyRequests, read("ana"))
+	require.Equal(t, http.StatusNotFound, read("ben"))
+}
+
+func TestRateLimitCors(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.RateLimit("things/*", OpRead, 1, time.Minute)
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	// browsers can read the wait of a throttled cross domain request
+	req, err := http.NewRequest("GET", "http://"+app.Address+"/things/1", nil)
+	require.NoError(t, err)
+	req.Header.Set("Origin", "http://example.com")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Contains(t, resp.Header.Get("Access-Control-Expose-Headers"), "Retry-After")
+}
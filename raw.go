@@ -0,0 +1,56 @@
+package katamari
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/benitogf/katamari/objects"
+	"github.com/benitogf/katamari/stream"
+)
+
+// RawMediaType content type of the raw json mode, data is embedded json instead of base64
+const RawMediaType = "application/vnd.katamari.raw+json"
+
+// rawQuery checks the raw query flag
+func rawQuery(r *http.Request) bool {
+	flag := r.URL.Query().Get("raw")
+	return flag == "1" || flag == "true"
+}
+
+// rawContent checks if a request body uses the raw json mode
+func rawContent(r *http.Request) bool {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return contentType == RawMediaType || rawQuery(r)
+}
+
+// rawAccept checks if a request expects the raw json mode on the response
+func rawAccept(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(accept))
+		if mediaType == RawMediaType {
+			return true
+		}
+	}
+	return rawQuery(r)
+}
+
+// getRawFilteredData filtered data in the raw json form
+func (app *Server) getRawFilteredData(ctx context.Context, key string) ([]byte, error) {
+	filteredData, err := app.getFilteredData(ctx, key)
+	if err != nil {
+		return filteredData, err
+	}
+	return objects.ToRaw(filteredData)
+}
+
+// fetchRaw data in the raw json form, update the raw cache and apply filter
+func (app *Server) fetchRaw(ctx context.Context, key string) (stream.Cache, error) {
+	err := app.filters.Read.checkStatic(key, app.Static)
+	if err != nil {
+		return stream.Cache{}, err
+	}
+
+	return app.Stream.RefreshRawCtx(ctx, key, app.getRawFilteredData)
+}
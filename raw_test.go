@@ -0,0 +1,121 @@
+package katamari
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRawRest(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req := httptest.NewRequest("POST", "/thing", bytes.NewBufferString(`{"data":{"name":"one"}}`))
+	req.Header.Set("Content-Type", RawMediaType)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	raw, err := app.Storage.Get("thing")
+	require.NoError(t, err)
+	obj, err := objects.Decode(raw)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"one"}`, obj.Data)
+
+	req = httptest.NewRequest("POST", "/things/*?raw=1", bytes.NewBufferString(`{"data":[1,2]}`))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	req = httptest.NewRequest("GET", "/thing", nil)
+	req.Header.Set("Accept", RawMediaType)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, RawMediaType, resp.Header.Get("Content-Type"))
+	var rawObj objects.RawObject
+	err = json.Unmarshal(body, &rawObj)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"one"}`, string(rawObj.Data))
+
+	req = httptest.NewRequest("GET", "/things/*?raw=true", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var rawList []objects.RawObject
+	err = json.Unmarshal(body, &rawList)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(rawList))
+	require.JSONEq(t, `[1,2]`, string(rawList[0].Data))
+
+	// the default format is unchanged
+	req = httptest.NewRequest("GET", "/thing", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp = w.Result()
+	body, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	require.Equal(t, string(raw), string(body))
+}
+
+func TestRawWebSocket(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.ForcePatch = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("thing", messages.Encode([]byte(`{"name":"one"}`)))
+	require.NoError(t, err)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/thing", RawQuery: "raw=1"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, message, err := c.ReadMessage()
+	require.NoError(t, err)
+	var snapshot messages.RawMessage
+	err = json.Unmarshal(message, &snapshot)
+	require.NoError(t, err)
+	require.True(t, snapshot.Snapshot)
+	var rawObj objects.RawObject
+	err = json.Unmarshal(snapshot.Data, &rawObj)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"name":"one"}`, string(rawObj.Data))
+
+	_, err = app.Storage.Set("thing", messages.Encode([]byte(`{"name":"two"}`)))
+	require.NoError(t, err)
+
+	_, message, err = c.ReadMessage()
+	require.NoError(t, err)
+	var patch messages.RawMessage
+	err = json.Unmarshal(message, &patch)
+	require.NoError(t, err)
+	require.False(t, patch.Snapshot)
+	require.Contains(t, string(patch.Data), `"path":"/data/name"`)
+	require.Contains(t, string(patch.Data), `"value":"two"`)
+}
@@ -2,14 +2,17 @@ package katamari
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/benitogf/katamari/key"
 	"github.com/benitogf/katamari/messages"
 	"github.com/benitogf/katamari/objects"
+	"github.com/benitogf/katamari/stream"
 	"github.com/gorilla/mux"
 )
 
@@ -18,65 +21,174 @@ func (app *Server) getStats(w http.ResponseWriter, r *http.Request) {
 		app.clock(w, r)
 		return
 	}
-	if !app.Audit(r) {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, "%s", errors.New("katamari: this request is not authorized"))
+	r, err := app.authorize(r, OpRead, "")
+	if err != nil {
+		writeError(w, "", err)
 		return
 	}
 
 	stats, err := app.Storage.Keys()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%s", err)
+		writeError(w, "", withCode(ErrInternal, err))
 		return
 	}
 
+	stats, err = app.filterStats(r.Context(), stats)
+	if err != nil {
+		writeError(w, "", withCode(ErrInternal, err))
+		return
+	}
+
+	limits := app.rateLimiter.stats(time.Now())
+	if len(limits) > 0 {
+		stats, err = withLimiterStats(stats, limits)
+		if err != nil {
+			writeError(w, "", withCode(ErrInternal, err))
+			return
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	w.Write(stats)
 }
 
 func (app *Server) publish(w http.ResponseWriter, r *http.Request) {
-	vkey := mux.Vars(r)["key"]
-	count := strings.Count(vkey, "*")
-	where := strings.Index(vkey, "*")
-	event, err := messages.DecodeReader(r.Body)
-	if !key.IsValid(vkey) || count > 1 || (count == 1 && where != len(vkey)-1) {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", errors.New("katamari: pathKeyError key is not valid"))
+	vkey, err := routeKey(r)
+	if err != nil {
+		writeError(w, vkey, err)
+		return
+	}
+	if !limitBody(w, r, vkey, app.bodyLimit(vkey)) {
+		return
+	}
+	decode := messages.DecodeReader
+	if rawContent(r) {
+		decode = messages.DecodeRawReader
+	}
+	body, err := readBody(r)
+	var event messages.Message
+	if err == nil {
+		event, err = decode(body)
+	}
+	if !validPublishKey(vkey) {
+		writeError(w, vkey, ErrInvalidKey)
+		return
+	}
+
+	r, authErr := app.authorize(r, OpWrite, vkey)
+	if authErr != nil {
+		writeError(w, vkey, authErr)
 		return
 	}
 
-	if !app.Audit(r) {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, "%s", errors.New("katamari: this request is not authorized"))
+	if !app.allowRate(w, r, OpWrite, vkey) {
 		return
 	}
 
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", err)
+		writeError(w, vkey, withCode(ErrInvalidData, err))
 		return
 	}
 
+	token := r.Header.Get(IdempotencyHeader)
+	sum := digest(event.Data + "\n" + r.FormValue("index"))
+	if token != "" {
+		token = idempotencyToken(r.Context(), vkey, token)
+		index, replay, err := app.idempotency.reserve(token, sum, app.IdempotencyWindow)
+		if err != nil {
+			writeError(w, vkey, err)
+			return
+		}
+		if replay {
+			app.Console.Log("publishReplay", vkey, index)
+			writeIndex(w, index)
+			return
+		}
+	}
+
+	index, err := app.store(r.Context(), vkey, r.FormValue("index"), []byte(event.Data))
+	if err != nil {
+		if token != "" {
+			app.idempotency.release(token)
+		}
+		writeError(w, vkey, err)
+		return
+	}
+
+	if token != "" {
+		app.idempotency.commit(token, sum, index, app.IdempotencyWindow)
+	}
+	writeIndex(w, index)
+}
+
+// routeKey decodes the key of a route, the router matches on the escaped path
+// so an escaped "/" is rejected instead of splitting a segment of the key
+func routeKey(r *http.Request) (string, error) {
+	escaped := mux.Vars(r)["key"]
+	reserved := strings.HasPrefix(escaped, "_")
+	if reserved {
+		// reserved keys are decoded like any other, the handlers check where they can be used
+		escaped = escaped[1:]
+	}
+	_key, err := key.Unescape(escaped)
+	if err != nil {
+		return mux.Vars(r)["key"], ErrInvalidKey
+	}
+	if reserved {
+		return "_" + _key, nil
+	}
+	return _key, nil
+}
+
+// validPublishKey checks that a key is valid for writes, only a trailing glob is allowed
+func validPublishKey(vkey string) bool {
+	count := strings.Count(vkey, "*")
+	where := strings.Index(vkey, "*")
+	return key.IsValid(vkey) && count <= 1 && (count == 0 || where == len(vkey)-1)
+}
+
+// store filtered data under a key built from the path and an optional client index
+func (app *Server) store(ctx context.Context, vkey string, clientIndex string, raw []byte) (string, error) {
 	_key := key.Build(vkey)
-	data, err := app.filters.Write.check(_key, []byte(event.Data), app.Static)
+	if clientIndex != "" {
+		if !strings.HasSuffix(vkey, "*") || !key.IsValid(clientIndex) ||
+			strings.ContainsAny(clientIndex, "/*") {
+			return "", ErrInvalidIndex
+		}
+		_key = vkey[:len(vkey)-1] + clientIndex
+	}
+
+	unlock := app.keyLocks.lock(_key)
+	if clientIndex != "" {
+		current, err := app.Storage.Get(_key)
+		if err == nil && len(current) > 0 {
+			unlock()
+			return "", errIndexExists
+		}
+	}
+
+	data, err := app.filters.Write.check(ctx, _key, raw, app.Static)
 	if err != nil {
+		unlock()
 		app.Console.Err("setError["+_key+"]", err)
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", err)
-		return
+		return "", err
 	}
 
+	before := app.auditBefore(_key)
 	index, err := app.Storage.Set(_key, string(data))
-
+	version := app.storedVersion(_key)
+	unlock()
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		fmt.Fprintf(w, "%s", err)
-		return
+		return "", withCode(ErrInternal, err)
 	}
 
 	app.Console.Log("publish", _key)
-	app.filters.After.check(_key)
+	app.changed(newChange(ctx, OpWrite, _key, before, string(data)).withVersion(version))
+	app.filters.After.check(ctx, _key)
+	return index, nil
+}
+
+func writeIndex(w http.ResponseWriter, index string) {
 	w.Header().Set("Content-Type", "application/json")
 	fmt.Fprintf(w, "%s", "{"+
 		"\"index\": \""+index+"\""+
@@ -84,21 +196,29 @@ func (app *Server) publish(w http.ResponseWriter, r *http.Request) {
 }
 
 func (app *Server) read(w http.ResponseWriter, r *http.Request) {
-	_key := mux.Vars(r)["key"]
-	if !key.IsValid(_key) {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", errors.New("katamari: pathKeyError key is not valid"))
+	_key, err := routeKey(r)
+	if err != nil || !key.IsValid(_key) && !validAuditKey(_key) {
+		writeError(w, _key, ErrInvalidKey)
+		return
+	}
+
+	operation := OpRead
+	if r.Header.Get("Upgrade") == "websocket" || acceptEventStream(r) {
+		operation = OpSubscribe
+	}
+
+	r, err = app.authorize(r, operation, _key)
+	if err != nil {
+		writeError(w, _key, err)
 		return
 	}
 
-	if !app.Audit(r) {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, "%s", errors.New("katamari: this request is not authorized"))
+	if !app.allowRate(w, r, operation, _key) {
 		return
 	}
 
 	if r.Header.Get("Upgrade") == "websocket" {
-		err := app.ws(w, r)
+		err := app.ws(w, r, _key)
 		if err != nil {
 			w.WriteHeader(http.StatusBadRequest)
 			return
@@ -106,58 +226,144 @@ func (app *Server) read(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if acceptEventStream(r) {
+		err := app.sse(w, r, _key)
+		if err != nil {
+			writeError(w, _key, err)
+		}
+		return
+	}
+
+	if r.URL.Query().Get("wait") != "" {
+		app.longPoll(w, r, _key)
+		return
+	}
+
 	app.Console.Log("read", _key)
-	entry, err := app.fetch(_key)
+	entry, err := app.fetch(r.Context(), _key)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", err)
+		writeError(w, _key, err)
 		return
 	}
+	app.writeEntry(w, r, _key, entry)
+}
+
+// writeEntry responds with the filtered data of a stream cache entry, json or raw by the accept header
+func (app *Server) writeEntry(w http.ResponseWriter, r *http.Request, _key string, entry stream.Cache) {
 	if bytes.Equal(entry.Data, objects.EmptyObject) {
-		w.WriteHeader(http.StatusNotFound)
-		fmt.Fprintf(w, "%s", errors.New("katamari: empty key"))
+		writeError(w, _key, errEmptyKey)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(entry.Data)
+	data, err := app.filterList(r.Context(), _key, entry.Data)
+	if err != nil {
+		writeError(w, _key, withCode(ErrInternal, err))
+		return
+	}
+
+	raw := rawAccept(r)
+	contentType := "application/json"
+	if raw {
+		data, err = objects.ToRaw(data)
+		if err != nil {
+			writeError(w, _key, withCode(ErrNotAcceptable, err))
+			return
+		}
+		contentType = RawMediaType
+	}
+
+	if !key.Contains(app.NoBroadcastKeys, _key) {
+		tag := etag(entry.Version, raw)
+		w.Header().Set("ETag", tag)
+		if modified, ok := lastModified(entry.Data); ok {
+			w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+		}
+		if matchETag(r.Header.Get("If-None-Match"), tag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+// etag of a stream cache version, the raw representation gets its own tag
+func etag(version int64, raw bool) string {
+	if raw {
+		return "\"" + strconv.FormatInt(version, 16) + "-raw\""
+	}
+	return "\"" + strconv.FormatInt(version, 16) + "\""
+}
+
+// matchETag checks an If-None-Match header against an etag
+func matchETag(header string, tag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// lastModified finds the latest created/updated timestamp of an object or list
+func lastModified(data []byte) (time.Time, bool) {
+	var latest int64
+	list, err := objects.DecodeListRaw(data)
+	if err != nil {
+		obj, err := objects.DecodeRaw(data)
+		if err != nil {
+			return time.Time{}, false
+		}
+		list = []objects.Object{obj}
+	}
+	for _, obj := range list {
+		latest = max(latest, obj.Created, obj.Updated)
+	}
+	if latest == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, latest), true
 }
 
 func (app *Server) unpublish(w http.ResponseWriter, r *http.Request) {
-	_key := mux.Vars(r)["key"]
-	if !key.IsValid(_key) {
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", errors.New("katamari: pathKeyError key is not valid"))
+	_key, err := routeKey(r)
+	if err != nil || !key.IsValid(_key) {
+		writeError(w, _key, ErrInvalidKey)
+		return
+	}
+
+	r, err = app.authorize(r, OpDelete, _key)
+	if err != nil {
+		writeError(w, _key, err)
 		return
 	}
 
-	if !app.Audit(r) {
-		w.WriteHeader(http.StatusUnauthorized)
-		fmt.Fprintf(w, "%s", errors.New("katamari: this request is not authorized"))
+	if !app.allowRate(w, r, OpDelete, _key) {
 		return
 	}
 
-	err := app.filters.Delete.check(_key, app.Static)
+	err = app.filters.Delete.check(r.Context(), _key, app.Static)
 	if err != nil {
 		app.Console.Err("detError["+_key+"]", err)
-		w.WriteHeader(http.StatusBadRequest)
-		fmt.Fprintf(w, "%s", err)
+		writeError(w, _key, err)
 		return
 	}
 
 	app.Console.Log("unpublish", _key)
+	before := app.auditBefore(_key)
 	err = app.Storage.Del(_key)
 
 	if err != nil {
 		app.Console.Err(err.Error())
-		if err.Error() == "leveldb: not found" || err.Error() == "katamari: not found" {
-			w.WriteHeader(http.StatusNotFound)
-		} else {
-			w.WriteHeader(http.StatusInternalServerError)
-		}
-		fmt.Fprintf(w, "%s", err)
+		writeError(w, _key, withCode(ErrInternal, err))
 		return
 	}
+	app.changed(newChange(r.Context(), OpDelete, _key, before, ""))
 
 	// this performs better than the watch channel
 	// if app.Storage.Watch() == nil {
@@ -9,6 +9,7 @@ import (
 	"testing"
 
 	"github.com/benitogf/katamari"
+	"github.com/benitogf/katamari/key"
 	"github.com/stretchr/testify/require"
 )
 
@@ -283,3 +284,74 @@ func TestRestDeleteInvalidKey(t *testing.T) {
 
 	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
 }
+
+func TestRestKeyCharset(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	keys := []string{
+		"users/0b9f4c1e-7a3d-4c55-9d4e-2f7e1a6b8c90",
+		"users/jane.doe+news@example.com",
+		"users/josé",
+		"users/名前",
+	}
+	for _, k := range keys {
+		req := httptest.NewRequest("POST", "/"+key.Escape(k), bytes.NewBufferString(`{"data":"eyJuYW1lIjoib25lIn0="}`))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode, k)
+
+		req = httptest.NewRequest("GET", "/"+key.Escape(k), nil)
+		w = httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Result().StatusCode, k)
+	}
+
+	req := httptest.NewRequest("GET", "/users/*", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	body, err := io.ReadAll(w.Result().Body)
+	require.NoError(t, err)
+	require.Equal(t, 4, bytes.Count(body, []byte(`"index"`)))
+	require.Contains(t, string(body), "josé")
+
+	for _, path := range []string{"/users/a%20b", "/users/a%3Fb", "/users/a%2Fb/*/*", "/users/.."} {
+		req = httptest.NewRequest("POST", path, bytes.NewBufferString(`{"data":"eyJuYW1lIjoib25lIn0="}`))
+		w = httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.NotEqual(t, http.StatusOK, w.Result().StatusCode, path)
+	}
+
+	// reserved keys are not reachable
+	req = httptest.NewRequest("GET", "/_webhooks/queue/*", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.NotEqual(t, http.StatusOK, w.Result().StatusCode)
+}
+
+func TestRestEncodedSlash(t *testing.T) {
+	t.Parallel()
+	app := katamari.Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	for _, method := range []string{"POST", "GET", "DELETE", "PATCH"} {
+		req := httptest.NewRequest(method, "/users/a%2Fb", bytes.NewBufferString(`{"data":"eyJuYW1lIjoib25lIn0="}`))
+		w := httptest.NewRecorder()
+		app.Router.ServeHTTP(w, req)
+		require.Equal(t, http.StatusBadRequest, w.Result().StatusCode, method)
+		require.Contains(t, w.Body.String(), "invalid_key", method)
+	}
+
+	// nothing was written under the split key
+	data, _ := app.Storage.Get("users/a/b")
+	require.Empty(t, data)
+	req := httptest.NewRequest("GET", "/users/a/b", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNotFound, w.Result().StatusCode)
+}
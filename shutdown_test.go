@@ -0,0 +1,156 @@
+package katamari
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStartE(t *testing.T) {
+	busy, err := net.Listen("tcp4", "localhost:0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	app := Server{}
+	app.Silence = true
+	err = app.StartE(busy.Addr().String())
+	require.Error(t, err)
+	require.False(t, app.Active())
+
+	app = Server{}
+	app.Silence = true
+	app.Network = "udp"
+	err = app.StartE("localhost:0")
+	require.ErrorIs(t, err, errNetwork)
+
+	app = Server{}
+	app.Silence = true
+	err = app.StartE("localhost:0")
+	require.NoError(t, err)
+	defer app.Close(os.Interrupt)
+	require.True(t, app.Active())
+	err = app.StartE("localhost:0")
+	require.ErrorIs(t, err, errAlreadyActive)
+}
+
+func TestShutdownCloseFrame(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/test"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	err = app.Shutdown(ctx)
+	require.NoError(t, err)
+	require.False(t, app.Active())
+
+	_, _, err = c.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway))
+
+	// a second shutdown is a noop
+	require.NoError(t, app.Shutdown(ctx))
+}
+
+func TestShutdownRejectsWrites(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	atomic.StoreInt64(&app.closing, 1)
+	data := messages.Encode([]byte(`{"name":"one"}`))
+	req := httptest.NewRequest("POST", "/things/1", strings.NewReader(`{"data":"`+data+`"}`))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	require.Contains(t, w.Body.String(), "unavailable")
+
+	req = httptest.NewRequest("DELETE", "/things/1", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusServiceUnavailable, w.Result().StatusCode)
+	atomic.StoreInt64(&app.closing, 0)
+}
+
+func TestShutdownLongPoll(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+
+	// connections that are open but idle would hold the shutdown
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	data := messages.Encode([]byte(`{"name":"one"}`))
+	resp, err := client.Post("http://"+app.Address+"/things/1", "application/json",
+		strings.NewReader(`{"data":"`+data+`"}`))
+	require.NoError(t, err)
+	resp.Body.Close()
+	resp, err = client.Get("http://" + app.Address + "/things/1")
+	require.NoError(t, err)
+	resp.Body.Close()
+	version := strings.Trim(resp.Header.Get("ETag"), "\"")
+
+	polled := make(chan int, 1)
+	go func() {
+		resp, err := client.Get("http://" + app.Address + "/things/1?v=" + version + "&wait=1m")
+		if err != nil {
+			polled <- 0
+			return
+		}
+		resp.Body.Close()
+		polled <- resp.StatusCode
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	require.NoError(t, app.Shutdown(ctx))
+	require.Less(t, time.Since(start), 5*time.Second)
+	require.Equal(t, http.StatusNotModified, <-polled)
+}
+
+func TestMemoryStorageCloseWhileSet(t *testing.T) {
+	db := &MemoryStorage{}
+	require.NoError(t, db.Start(StorageOpt{}))
+
+	// nobody reads the watcher, the sets block until the storage closes
+	done := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		go func() {
+			_, _ = db.Set("things/1", "e30=")
+			done <- struct{}{}
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	db.Close()
+	for i := 0; i < 10; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("set blocked after the storage closed")
+		}
+	}
+	require.Nil(t, db.Watch())
+	db.Close()
+	_, err := db.Set("things/2", "e30=")
+	require.NoError(t, err)
+}
@@ -0,0 +1,63 @@
+package katamari
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/stream"
+)
+
+// acceptEventStream checks if a request expects server sent events
+func acceptEventStream(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, _ := mime.ParseMediaType(strings.TrimSpace(accept))
+		if mediaType == stream.EventStreamType {
+			return true
+		}
+	}
+	return false
+}
+
+// sse subscription, an alternative transport to the websocket subscription
+func (app *Server) sse(w http.ResponseWriter, r *http.Request, _key string) error {
+	version := r.FormValue("v")
+	if version == "" {
+		version = r.Header.Get("Last-Event-ID")
+	}
+
+	err := app.filters.Read.checkStatic(_key, app.Static)
+	if err != nil {
+		app.Console.Err("katamari: filtered route", err)
+		return err
+	}
+
+	raw := rawAccept(r)
+	fetch := app.fetch
+	encode := messages.Encode
+	if raw {
+		fetch = app.fetchRaw
+		encode = func(data []byte) string { return string(data) }
+	}
+
+	client, err := app.Stream.NewEventStream(_key, raw, w, r)
+	if err != nil {
+		return err
+	}
+
+	// send initial msg, the data of the pool that the client joined
+	entry, err := fetch(app.Stream.PoolContext(client), _key)
+	if err != nil {
+		app.Console.Err("katamari: filtered route", err)
+		app.Stream.Close(_key, client)
+		return nil
+	}
+
+	if version != strconv.FormatInt(entry.Version, 16) {
+		app.Stream.Write(client, encode(entry.Data), true, entry.Version)
+	}
+	app.Stream.Read(_key, client)
+	return nil
+}
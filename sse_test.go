@@ -0,0 +1,147 @@
+package katamari
+
+import (
+	"bufio"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/stretchr/testify/require"
+)
+
+// readEvent reads the id and data of the next server sent event
+func readEvent(t *testing.T, reader *bufio.Reader) (string, string) {
+	id := ""
+	data := ""
+	for {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			return id, data
+		}
+		if strings.HasPrefix(line, "id: ") {
+			id = strings.TrimPrefix(line, "id: ")
+		}
+		if strings.HasPrefix(line, "data: ") {
+			data += strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	app := Server{}
+	app.Silence = true
+	subscribed := make(chan string, 1)
+	unsubscribed := make(chan string, 1)
+	app.OnSubscribe = func(key string) error {
+		subscribed <- key
+		return nil
+	}
+	app.OnUnsubscribe = func(key string) {
+		unsubscribed <- key
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	_, err := app.Storage.Set("thing", messages.Encode([]byte(`{"name":"one"}`)))
+	require.NoError(t, err)
+
+	req, err := http.NewRequest("GET", "http://"+app.Address+"/thing", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	require.Equal(t, "thing", <-subscribed)
+	reader := bufio.NewReader(resp.Body)
+
+	id, data := readEvent(t, reader)
+	event, err := messages.DecodeBuffer([]byte(data))
+	require.NoError(t, err)
+	require.True(t, event.Snapshot)
+	require.Equal(t, event.Version, id)
+	require.Contains(t, event.Data, messages.Encode([]byte(`{"name":"one"}`)))
+
+	_, err = app.Storage.Set("thing", messages.Encode([]byte(`{"name":"two"}`)))
+	require.NoError(t, err)
+	id, data = readEvent(t, reader)
+	event, err = messages.DecodeBuffer([]byte(data))
+	require.NoError(t, err)
+	require.Equal(t, event.Version, id)
+
+	resp.Body.Close()
+	require.Equal(t, "thing", <-unsubscribed)
+
+	// reconnecting with the last event id skips the initial message
+	req, err = http.NewRequest("GET", "http://"+app.Address+"/thing", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	req.Header.Set("Last-Event-ID", id)
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "thing", <-subscribed)
+	reader = bufio.NewReader(resp.Body)
+	_, err = app.Storage.Set("thing", messages.Encode([]byte(`{"name":"three"}`)))
+	require.NoError(t, err)
+	nextID, _ := readEvent(t, reader)
+	require.NotEqual(t, id, nextID)
+}
+
+func TestEventStreamAudit(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Audit = func(r *http.Request) bool {
+		return r.Header.Get("Authorization") == "yes"
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req, err := http.NewRequest("GET", "http://"+app.Address+"/thing", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestEventStreamShutdown(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+
+	req, err := http.NewRequest("GET", "http://"+app.Address+"/thing", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	readEvent(t, reader)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		app.Close(os.Interrupt)
+		wg.Done()
+	}()
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown blocked by the event stream")
+	}
+}
@@ -37,6 +37,11 @@ type StorageOpt struct {
 //
 // Del(key): Delete a key from the storage
 //
+// the glob patterns of KeysRange, Get, GetN, GetNRange and Del should only match the reserved keys (the audit log
+// and webhook queue) when the pattern starts with their prefix
+//
+// ErrNotFound: Get and Del should return it, or an error wrapping it, for a missing key
+//
 // Clear: will clear all keys from the storage (used for testing)
 //
 // Watch: returns a channel that will receive any set or del operation
@@ -64,7 +69,8 @@ type Storage struct {
 
 // Stats data structure of global keys
 type Stats struct {
-	Keys []string `json:"keys"`
+	Keys   []string       `json:"keys"`
+	Limits []LimiterStats `json:"limits,omitempty"`
 }
 
 // WatchStorageNoop a noop reader of the watch channel
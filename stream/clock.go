@@ -1,11 +1,5 @@
 package stream
 
-import (
-	"time"
-
-	"github.com/gorilla/websocket"
-)
-
 // BroadcastClock sends time to all the subscribers
 func (sm *Stream) BroadcastClock(data string) {
 	sm.mutex.RLock()
@@ -21,10 +15,9 @@ func (sm *Stream) BroadcastClock(data string) {
 func (sm *Stream) WriteClock(client *Conn, data string) {
 	client.mutex.Lock()
 	defer client.mutex.Unlock()
-	client.conn.SetWriteDeadline(time.Now().Add(timeout))
-	err := client.conn.WriteMessage(websocket.BinaryMessage, []byte(data))
+	err := client.writeMessage("", []byte(data))
 	if err != nil {
-		client.conn.Close()
+		client.close()
 		sm.Console.Log("writeTimeStreamErr: ", err)
 	}
 }
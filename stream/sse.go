@@ -0,0 +1,114 @@
+package stream
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// EventStreamType content type of server sent events
+const EventStreamType = "text/event-stream"
+
+// eventStream server sent events writer
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	done    chan struct{}
+	gone    <-chan struct{}
+	once    sync.Once
+	closed  bool
+}
+
+// write an event, each line of the data goes on its own data field
+func (es *eventStream) write(id string, data []byte) error {
+	if es.closed {
+		return errors.New("event stream closed")
+	}
+	var buf bytes.Buffer
+	if id != "" {
+		buf.WriteString("id: " + id + "\n")
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		buf.WriteString("data: ")
+		buf.Write(line)
+		buf.WriteString("\n")
+	}
+	buf.WriteString("\n")
+	_, err := es.w.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	es.flusher.Flush()
+	return nil
+}
+
+func (es *eventStream) close() {
+	es.closed = true
+	es.once.Do(func() {
+		close(es.done)
+	})
+}
+
+// NewEventStream opens a server sent events stream on a key
+//
+// raw streams receive embedded json messages
+func (sm *Stream) NewEventStream(key string, raw bool, w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("stream: event stream not supported")
+	}
+
+	err := sm.subscribe(r.Context(), key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the stream outlives the server write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", EventStreamType)
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	client := &Conn{
+		sse: &eventStream{
+			w:       w,
+			flusher: flusher,
+			done:    make(chan struct{}),
+			gone:    r.Context().Done(),
+		},
+		raw: raw,
+		ctx: r.Context(),
+	}
+	sm.add(key, client)
+	return client, nil
+}
+
+// readEventStream blocks until the client goes away or the stream is closed
+func (sm *Stream) readEventStream(key string, client *Conn) {
+	select {
+	case <-client.sse.gone:
+	case <-client.sse.done:
+	}
+	sm.Close(key, client)
+}
+
+// CloseEventStreams ends all the server sent events streams
+func (sm *Stream) CloseEventStreams() {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	for _, pool := range sm.pools {
+		for _, client := range pool.connections {
+			if client.sse == nil {
+				continue
+			}
+			client.mutex.Lock()
+			client.close()
+			client.mutex.Unlock()
+		}
+	}
+}
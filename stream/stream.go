@@ -1,6 +1,7 @@
 package stream
 
 import (
+	"context"
 	"errors"
 	"net/http"
 	"strconv"
@@ -26,40 +27,116 @@ type Subscribe func(key string) error
 // Unsubscribe : function callback on subscription closing
 type Unsubscribe func(key string)
 
+// SubscribeCtx : monitoring or filtering of subscriptions with the context of the subscribe request
+type SubscribeCtx func(ctx context.Context, key string) error
+
+// UnsubscribeCtx : function callback on subscription closing with the context of the subscribe request
+type UnsubscribeCtx func(ctx context.Context, key string)
+
 type GetFn func(key string) ([]byte, error)
 
+// GetCtxFn data getter that receives a context, the context of the pool on broadcasts
+type GetCtxFn func(ctx context.Context, key string) ([]byte, error)
+
+// Scope : partition of the pools by the context of a subscribe request,
+// returns the name of the scope and the context used to get the data of its pools,
+// the data is shared by the connections of a pool so the context should not depend on a single request
+type Scope func(ctx context.Context) (string, context.Context)
+
 type EncodeFn func(data []byte) string
 
 // Conn extends the websocket connection with a mutex
 // https://godoc.org/github.com/gorilla/websocket#hdr-Concurrency
+//
+// event stream connections use the sse writer instead of a websocket
 type Conn struct {
-	mutex sync.Mutex
-	conn  *websocket.Conn
+	mutex   sync.Mutex
+	conn    *websocket.Conn
+	sse     *eventStream
+	raw     bool
+	ctx     context.Context
+	scope   string
+	poolCtx context.Context
+}
+
+// writeMessage to the connection, the client mutex should be held
+//
+// id is only used by event streams
+func (client *Conn) writeMessage(id string, data []byte) error {
+	if client.sse != nil {
+		return client.sse.write(id, data)
+	}
+	client.conn.SetWriteDeadline(time.Now().Add(timeout))
+	return client.conn.WriteMessage(websocket.BinaryMessage, data)
+}
+
+// close the underlying connection
+func (client *Conn) close() {
+	if client.sse != nil {
+		client.sse.close()
+		return
+	}
+	client.conn.Close()
 }
 
 // Pool of key filtered connections
+//
+// # Raw pools hold connections that receive embedded json instead of base64 data
+//
+// Scoped pools hold the connections of a scope, their data is filtered with the context of the scope,
+// they are dropped with their last connection
 type Pool struct {
 	mutex       sync.RWMutex
 	Key         string
+	Raw         bool
+	Scope       string
+	ctx         context.Context
 	cache       Cache
+	changed     chan struct{}
 	connections []*Conn
 }
 
 // Stream a group of pools
+//
+// ReadLimit: largest inbound websocket message allowed on a key, unlimited when not defined
+//
+// OnSubscribeCtx, OnUnsubscribeCtx: optional callbacks that also receive the context of the subscribe request,
+// they run after OnSubscribe and OnUnsubscribe
+//
+// Scope: optional partition of the pools, connections of a key in different scopes don't share a pool,
+// the clock is never scoped and a scoped pool is dropped with its last connection
 type Stream struct {
-	mutex         sync.RWMutex
-	OnSubscribe   Subscribe
-	OnUnsubscribe Unsubscribe
-	ForcePatch    bool
-	NoPatch       bool
-	pools         []*Pool
-	Console       *coat.Console
+	mutex            sync.RWMutex
+	OnSubscribe      Subscribe
+	OnUnsubscribe    Unsubscribe
+	OnSubscribeCtx   SubscribeCtx
+	OnUnsubscribeCtx UnsubscribeCtx
+	ForcePatch       bool
+	NoPatch          bool
+	ReadLimit        func(key string) int64
+	Scope            Scope
+	pools            []*Pool
+	Console          *coat.Console
 }
 
+// BroadcastOpt options of a broadcast
+//
+// Get: data getter for the pools
+//
+// GetRaw: data getter for raw pools, raw pools are skipped if not defined
+//
+// GetCtx, GetRawCtx: optional data getters that receive the context of the pool, they take the place of Get and GetRaw
+//
+// Encode: encoding of the data sent to the pools, raw pools send the data as is
+//
+// Callback: function called after a pool broadcast
 type BroadcastOpt struct {
-	Get      GetFn
-	Encode   EncodeFn
-	Callback func()
+	Get       GetFn
+	GetRaw    GetFn
+	GetCtx    GetCtxFn
+	GetRawCtx GetCtxFn
+	Encode    EncodeFn
+	Callback  func()
 }
 
 // Cache holds version and data
@@ -76,10 +153,10 @@ var StreamUpgrader = websocket.Upgrader{
 	Subprotocols: []string{"bearer"},
 }
 
-func (sm *Stream) findPool(key string) int {
+func (sm *Stream) findPool(key string, raw bool, scope string) int {
 	poolIndex := -1
 	for i := range sm.pools {
-		if sm.pools[i].Key == key {
+		if sm.pools[i].Key == key && sm.pools[i].Raw == raw && sm.pools[i].Scope == scope {
 			poolIndex = i
 			break
 		}
@@ -96,9 +173,59 @@ func (sm *Stream) InitClock() {
 	}
 }
 
+// scope of a context, without a Scope function every connection is in the unscoped pools
+func (sm *Stream) scope(ctx context.Context) (string, context.Context) {
+	if sm.Scope == nil || ctx == nil {
+		return "", context.Background()
+	}
+	return sm.Scope(ctx)
+}
+
+// PoolContext context used to get the data of the pool that a connection joined,
+// the first message should be filtered with it to match the updates of the pool
+func (sm *Stream) PoolContext(client *Conn) context.Context {
+	if client.poolCtx == nil {
+		return context.Background()
+	}
+	return client.poolCtx
+}
+
 // New stream on a key
 func (sm *Stream) New(key string, w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	return sm.open(key, false, w, r)
+}
+
+// NewRaw stream on a key that will receive embedded json messages
+func (sm *Stream) NewRaw(key string, w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	return sm.open(key, true, w, r)
+}
+
+// subscribe runs the subscribe callbacks
+func (sm *Stream) subscribe(ctx context.Context, key string) error {
 	err := sm.OnSubscribe(key)
+	if err != nil {
+		return err
+	}
+	if sm.OnSubscribeCtx != nil {
+		return sm.OnSubscribeCtx(ctx, key)
+	}
+	return nil
+}
+
+// unsubscribe runs the unsubscribe callbacks
+func (sm *Stream) unsubscribe(client *Conn, key string) {
+	sm.OnUnsubscribe(key)
+	if sm.OnUnsubscribeCtx != nil {
+		ctx := client.ctx
+		if ctx == nil {
+			ctx = context.Background()
+		}
+		sm.OnUnsubscribeCtx(ctx, key)
+	}
+}
+
+func (sm *Stream) open(key string, raw bool, w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	err := sm.subscribe(r.Context(), key)
 	if err != nil {
 		return nil, err
 	}
@@ -110,37 +237,87 @@ func (sm *Stream) New(key string, w http.ResponseWriter, r *http.Request) (*Conn
 		return nil, err
 	}
 
-	return sm.new(key, wsClient), nil
+	if sm.ReadLimit != nil {
+		wsClient.SetReadLimit(sm.ReadLimit(key))
+	}
+
+	return sm.new(r.Context(), key, raw, wsClient), nil
 }
 
 // Open a connection for a key
-func (sm *Stream) new(key string, wsClient *websocket.Conn) *Conn {
+func (sm *Stream) new(ctx context.Context, key string, raw bool, wsClient *websocket.Conn) *Conn {
 	client := &Conn{
 		conn:  wsClient,
 		mutex: sync.Mutex{},
+		raw:   raw,
+		ctx:   ctx,
 	}
 
+	sm.add(key, client)
+	return client
+}
+
+// add a connection to the pool of a key in the scope of the connection, the clock is not scoped
+func (sm *Stream) add(key string, client *Conn) {
+	scope, poolCtx := "", context.Background()
+	if key != "" {
+		scope, poolCtx = sm.scope(client.ctx)
+	}
+	client.scope = scope
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
-	poolIndex := sm.findPool(key)
+	poolIndex := sm.findPool(key, client.raw, scope)
 	if poolIndex == -1 {
 		// create a pool
+		client.poolCtx = poolCtx
 		sm.pools = append(
 			sm.pools,
 			&Pool{
 				Key:         key,
+				Raw:         client.raw,
+				Scope:       scope,
+				ctx:         poolCtx,
 				connections: []*Conn{client}})
 		poolIndex = len(sm.pools) - 1
 		sm.Console.Log("connections["+key+"]: ", len(sm.pools[poolIndex].connections))
-		return client
+		return
 	}
 
 	// use existing pool
+	client.poolCtx = sm.pools[poolIndex].ctx
 	sm.pools[poolIndex].connections = append(
 		sm.pools[poolIndex].connections,
 		client)
 	sm.Console.Log("connections["+key+"]: ", len(sm.pools[poolIndex].connections))
-	return client
+}
+
+// Count of pools and connections
+func (sm *Stream) Count() (int, int) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	connections := 0
+	for _, pool := range sm.pools {
+		pool.mutex.RLock()
+		connections += len(pool.connections)
+		pool.mutex.RUnlock()
+	}
+	return len(sm.pools), connections
+}
+
+// Subscribers count of the connections that receive the updates of a key,
+// includes the subscriptions to globs that match the key
+func (sm *Stream) Subscribers(_key string) int {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	count := 0
+	for _, pool := range sm.pools {
+		if pool.Key != "" && (pool.Key == _key || key.Match(pool.Key, _key)) {
+			pool.mutex.RLock()
+			count += len(pool.connections)
+			pool.mutex.RUnlock()
+		}
+	}
+	return count
 }
 
 // Close client connection
@@ -150,18 +327,57 @@ func (sm *Stream) Close(key string, client *Conn) {
 
 	// loop to remove this client
 	sm.mutex.Lock()
-	poolIndex := sm.findPool(key)
-	for _, v := range sm.pools[poolIndex].connections {
-		if v != client {
-			na = append(na, v)
+	poolIndex := sm.findPool(key, client.raw, client.scope)
+	if poolIndex != -1 {
+		for _, v := range sm.pools[poolIndex].connections {
+			if v != client {
+				na = append(na, v)
+			}
 		}
-	}
 
-	// replace clients array with the auxiliar
-	sm.pools[poolIndex].connections = na
+		// replace clients array with the auxiliar
+		sm.pools[poolIndex].connections = na
+		if len(na) == 0 && client.scope != "" {
+			sm.drop(poolIndex)
+		}
+	}
 	sm.mutex.Unlock()
-	go sm.OnUnsubscribe(key)
-	client.conn.Close()
+	go sm.unsubscribe(client, key)
+	client.mutex.Lock()
+	client.close()
+	client.mutex.Unlock()
+}
+
+// drop an empty scoped pool, the stream mutex should be held
+//
+// the waits on the pool are released since it won't change anymore
+func (sm *Stream) drop(poolIndex int) {
+	pool := sm.pools[poolIndex]
+	pool.mutex.Lock()
+	if pool.changed != nil {
+		close(pool.changed)
+		pool.changed = nil
+	}
+	pool.mutex.Unlock()
+	sm.pools = append(sm.pools[:poolIndex], sm.pools[poolIndex+1:]...)
+}
+
+// CloseConnections ends every connection of the pools, websockets receive a going away close frame
+func (sm *Stream) CloseConnections() {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	for _, pool := range sm.pools {
+		for _, client := range pool.connections {
+			client.mutex.Lock()
+			if client.sse == nil {
+				_ = client.conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutdown"),
+					time.Now().Add(timeout))
+			}
+			client.close()
+			client.mutex.Unlock()
+		}
+	}
 }
 
 // Broadcast will look for pools that match a path and broadcast updates
@@ -171,8 +387,16 @@ func (sm *Stream) Broadcast(path string, opt BroadcastOpt) {
 	// skip pool 0 (clock)
 	for poolIndex := 1; poolIndex < len(sm.pools); poolIndex++ {
 		if key.Peer(sm.pools[poolIndex].Key, path) {
+			get := opt.getter(sm.pools[poolIndex])
+			if get == nil {
+				continue
+			}
+			encode := opt.Encode
+			if sm.pools[poolIndex].Raw {
+				encode = func(data []byte) string { return string(data) }
+			}
 			sm.pools[poolIndex].mutex.Lock()
-			data, err := opt.Get(sm.pools[poolIndex].Key)
+			data, err := get(sm.pools[poolIndex].Key)
 			// this error means that the broadcast was filtered
 			if err != nil {
 				sm.Console.Err("broadcast["+sm.pools[poolIndex].Key+"]: failed to get data", err)
@@ -181,7 +405,7 @@ func (sm *Stream) Broadcast(path string, opt BroadcastOpt) {
 			}
 
 			modifiedData, snapshot, version := sm.Patch(poolIndex, data)
-			sm.broadcast(poolIndex, opt.Encode(modifiedData), snapshot, version)
+			sm.broadcast(poolIndex, encode(modifiedData), snapshot, version)
 			sm.pools[poolIndex].mutex.Unlock()
 			if opt.Callback != nil {
 				opt.Callback()
@@ -190,6 +414,24 @@ func (sm *Stream) Broadcast(path string, opt BroadcastOpt) {
 	}
 }
 
+// getter of the data of a pool, nil if the pool is skipped
+func (opt BroadcastOpt) getter(pool *Pool) GetFn {
+	get, getCtx := opt.Get, opt.GetCtx
+	if pool.Raw {
+		get, getCtx = opt.GetRaw, opt.GetRawCtx
+	}
+	if getCtx == nil {
+		return get
+	}
+	ctx := pool.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return func(key string) ([]byte, error) {
+		return getCtx(ctx, key)
+	}
+}
+
 // broadcast message
 func (sm *Stream) broadcast(poolIndex int, data string, snapshot bool, version int64) {
 	connections := sm.pools[poolIndex].connections
@@ -232,24 +474,37 @@ func (sm *Stream) Patch(poolIndex int, data []byte) ([]byte, bool, int64) {
 }
 
 // Write will write data to a ws connection
+//
+// raw connections embed the data, otherwise it's sent as a string
 func (sm *Stream) Write(client *Conn, data string, snapshot bool, version int64) {
 	client.mutex.Lock()
 	defer client.mutex.Unlock()
-	client.conn.SetWriteDeadline(time.Now().Add(timeout))
-	err := client.conn.WriteMessage(websocket.BinaryMessage, []byte("{"+
-		"\"snapshot\": "+strconv.FormatBool(snapshot)+","+
-		"\"version\": \""+strconv.FormatInt(version, 16)+"\","+
-		"\"data\": \""+data+"\""+
-		"}"))
+	err := client.writeMessage(strconv.FormatInt(version, 16), EncodeMessage(data, snapshot, version, client.raw))
 
 	if err != nil {
-		client.conn.Close()
+		client.close()
 		sm.Console.Log("writeStreamErr: ", err)
 	}
 }
 
+// EncodeMessage formats a stream message, raw messages embed the data, otherwise it's sent as a string
+func EncodeMessage(data string, snapshot bool, version int64, raw bool) []byte {
+	if !raw {
+		data = "\"" + data + "\""
+	}
+	return []byte("{" +
+		"\"snapshot\": " + strconv.FormatBool(snapshot) + "," +
+		"\"version\": \"" + strconv.FormatInt(version, 16) + "\"," +
+		"\"data\": " + data +
+		"}")
+}
+
 // Read will keep alive the ws connection
 func (sm *Stream) Read(key string, client *Conn) {
+	if client.sse != nil {
+		sm.readEventStream(key, client)
+		return
+	}
 	for {
 		_, _, err := client.conn.NextReader()
 		if err != nil {
@@ -265,21 +520,37 @@ func (sm *Stream) _setCache(poolIndex int, data []byte) int64 {
 	now := time.Now().UTC().UnixNano()
 	sm.pools[poolIndex].cache.Version = now
 	sm.pools[poolIndex].cache.Data = data
+	if sm.pools[poolIndex].changed != nil {
+		close(sm.pools[poolIndex].changed)
+		sm.pools[poolIndex].changed = nil
+	}
 	return now
 }
 
 // SetCache by key
-func (sm *Stream) setCache(key string, data []byte) int64 {
+func (sm *Stream) setCache(key string, raw bool, data []byte) int64 {
+	return sm.setScopedCache(key, raw, "", nil, data)
+}
+
+// setScopedCache stores data in the cache of a pool of a scope, only unscoped pools are created here,
+// scoped pools belong to their connections
+func (sm *Stream) setScopedCache(key string, raw bool, scope string, poolCtx context.Context, data []byte) int64 {
 	sm.mutex.Lock()
 	defer sm.mutex.Unlock()
-	poolIndex := sm.findPool(key)
+	poolIndex := sm.findPool(key, raw, scope)
 	if poolIndex == -1 {
 		now := time.Now().UTC().UnixNano()
+		if scope != "" {
+			return now
+		}
 		// create a pool
 		sm.pools = append(
 			sm.pools,
 			&Pool{
-				Key: key,
+				Key:   key,
+				Raw:   raw,
+				Scope: scope,
+				ctx:   poolCtx,
 				cache: Cache{
 					Version: now,
 					Data:    data,
@@ -291,11 +562,36 @@ func (sm *Stream) setCache(key string, data []byte) int64 {
 	return sm._setCache(poolIndex, data)
 }
 
-// GetCache by key
+// GetCacheVersion by key
 func (sm *Stream) GetCacheVersion(key string) (int64, error) {
+	return sm.getCacheVersion(key, false, "")
+}
+
+// GetRawCacheVersion by key of a raw pool
+func (sm *Stream) GetRawCacheVersion(key string) (int64, error) {
+	return sm.getCacheVersion(key, true, "")
+}
+
+// readScope of the pool that a read in a scope uses and its context, the scoped pool if it has connections,
+// the unscoped pool otherwise so plain reads don't create scoped pools
+func (sm *Stream) readScope(ctx context.Context, key string, raw bool) (string, context.Context) {
+	scope, poolCtx := sm.scope(ctx)
+	if scope == "" {
+		return scope, poolCtx
+	}
 	sm.mutex.RLock()
 	defer sm.mutex.RUnlock()
-	poolIndex := sm.findPool(key)
+	poolIndex := sm.findPool(key, raw, scope)
+	if poolIndex == -1 {
+		return "", context.Background()
+	}
+	return scope, sm.pools[poolIndex].ctx
+}
+
+func (sm *Stream) getCacheVersion(key string, raw bool, scope string) (int64, error) {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+	poolIndex := sm.findPool(key, raw, scope)
 	if poolIndex == -1 {
 		return 0, errors.New("stream pool not found")
 	}
@@ -308,24 +604,113 @@ func (sm *Stream) GetCacheVersion(key string) (int64, error) {
 	return sm.pools[poolIndex].cache.Version, nil
 }
 
+// Wait blocks until the cache version of a key in the scope of the context differs from the version,
+// without connections in the scope the version is the one of the unscoped pool
+//
+// returns false if the context is done before a change
+func (sm *Stream) Wait(ctx context.Context, key string, version int64) bool {
+	return sm.wait(ctx, key, false, version)
+}
+
+// WaitRaw blocks until the cache version of a raw pool in the scope of the context differs from the version
+//
+// returns false if the context is done before a change
+func (sm *Stream) WaitRaw(ctx context.Context, key string, version int64) bool {
+	return sm.wait(ctx, key, true, version)
+}
+
+func (sm *Stream) wait(ctx context.Context, key string, raw bool, version int64) bool {
+	scope, _ := sm.readScope(ctx, key, raw)
+	sm.mutex.RLock()
+	poolIndex := sm.findPool(key, raw, scope)
+	if poolIndex == -1 {
+		sm.mutex.RUnlock()
+		return true
+	}
+	pool := sm.pools[poolIndex]
+	pool.mutex.Lock()
+	if pool.cache.Version != version {
+		pool.mutex.Unlock()
+		sm.mutex.RUnlock()
+		return true
+	}
+	if pool.changed == nil {
+		pool.changed = make(chan struct{})
+	}
+	changed := pool.changed
+	pool.mutex.Unlock()
+	sm.mutex.RUnlock()
+
+	select {
+	case <-changed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Refresh get the data of a path along with the pool cache version
 func (sm *Stream) Refresh(path string, getDataFn GetFn) (Cache, error) {
-	raw, err := getDataFn(path)
+	return sm.RefreshCtx(context.Background(), path, func(_ context.Context, key string) ([]byte, error) {
+		return getDataFn(key)
+	})
+}
+
+// RefreshRaw get the data of a path along with the raw pool cache version
+func (sm *Stream) RefreshRaw(path string, getDataFn GetFn) (Cache, error) {
+	return sm.RefreshRawCtx(context.Background(), path, func(_ context.Context, key string) ([]byte, error) {
+		return getDataFn(key)
+	})
+}
+
+// RefreshCtx get the data of a path with a context along with the cache version of the pool in the scope of the context,
+// or of the unscoped pool when the scope has no connections, a missing cache is filled with the data got with the
+// context of the pool instead
+func (sm *Stream) RefreshCtx(ctx context.Context, path string, getDataFn GetCtxFn) (Cache, error) {
+	return sm.refresh(ctx, path, false, getDataFn)
+}
+
+// RefreshRawCtx get the data of a path with a context along with the cache version of the raw pool in the scope of the context
+func (sm *Stream) RefreshRawCtx(ctx context.Context, path string, getDataFn GetCtxFn) (Cache, error) {
+	return sm.refresh(ctx, path, true, getDataFn)
+}
+
+func (sm *Stream) refresh(ctx context.Context, path string, rawPool bool, getDataFn GetCtxFn) (Cache, error) {
+	raw, err := getData(ctx, path, getDataFn)
 	if err != nil {
 		return Cache{}, err
 	}
-	if len(raw) == 0 {
-		raw = objects.EmptyObject
-	}
 	cache := Cache{
 		Data: raw,
 	}
-	cacheVersion, err := sm.GetCacheVersion(path)
-	if err != nil {
-		newVersion := sm.setCache(path, raw)
-		cache.Version = newVersion
+	scope, poolCtx := sm.readScope(ctx, path, rawPool)
+	cacheVersion, err := sm.getCacheVersion(path, rawPool, scope)
+	if err == nil {
+		cache.Version = cacheVersion
 		return cache, nil
 	}
 
-	cache.Version = cacheVersion
+	// the cache is shared by the connections of the pool, never seed it with the data of a request,
+	// data filtered for the pool is cached as empty, its connections won't receive it either
+	seed := raw
+	if poolCtx != ctx {
+		seed, err = getData(poolCtx, path, getDataFn)
+		if err != nil {
+			seed = objects.EmptyObject
+		}
+	}
+	cache.Version = sm.setScopedCache(path, rawPool, scope, poolCtx, seed)
 	return cache, nil
 }
+
+// getData of a path, empty data is an empty object
+func getData(ctx context.Context, path string, getDataFn GetCtxFn) ([]byte, error) {
+	raw, err := getDataFn(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		raw = objects.EmptyObject
+	}
+	return raw, nil
+}
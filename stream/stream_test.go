@@ -48,7 +48,7 @@ func TestSnapshot(t *testing.T) {
 	require.Equal(t, testKey, stream.pools[0].Key)
 	require.Equal(t, 1, len(stream.pools[0].connections))
 
-	stream.setCache(testKey, []byte(testData))
+	stream.setCache(testKey, false, []byte(testData))
 
 	cacheVersion, err := stream.GetCacheVersion(testKey)
 	require.NoError(t, err)
@@ -90,7 +90,7 @@ func TestPatch(t *testing.T) {
 	require.Equal(t, testKey, stream.pools[0].Key)
 	require.Equal(t, 1, len(stream.pools[0].connections))
 
-	stream.setCache(testKey, []byte(testData))
+	stream.setCache(testKey, false, []byte(testData))
 
 	cacheVersion, err := stream.GetCacheVersion(testKey)
 	require.NoError(t, err)
@@ -143,8 +143,8 @@ func TestConcurrentBroadcast(t *testing.T) {
 	require.Equal(t, "b", stream.pools[2].Key)
 	require.Equal(t, 1, len(stream.pools[2].connections))
 
-	stream.setCache("a", []byte(testData))
-	stream.setCache("b", []byte(testData))
+	stream.setCache("a", false, []byte(testData))
+	stream.setCache("b", false, []byte(testData))
 
 	fakeGet := func(key string) ([]byte, error) {
 		return []byte(testData), nil
@@ -0,0 +1,125 @@
+package katamari
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval minimum time between checks of the certificate files
+const certCheckInterval = time.Second
+
+var errClientCAs = errors.New("katamari: tlsError no certificates found in the client CA file")
+
+// certReloader serves a certificate pair and loads it again when the files change
+type certReloader struct {
+	mutex    sync.Mutex
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modified time.Time
+	checked  time.Time
+}
+
+// modTime latest modification of the certificate files
+func (cr *certReloader) modTime() (time.Time, error) {
+	certInfo, err := os.Stat(cr.certFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	keyInfo, err := os.Stat(cr.keyFile)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if keyInfo.ModTime().After(certInfo.ModTime()) {
+		return keyInfo.ModTime(), nil
+	}
+	return certInfo.ModTime(), nil
+}
+
+func (cr *certReloader) load() error {
+	modified, err := cr.modTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+	cr.cert = &cert
+	cr.modified = modified
+	return nil
+}
+
+// GetCertificate of the handshake, a pair that fails to load keeps the previous one in use
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(cr.checked) < certCheckInterval {
+		return cr.cert, nil
+	}
+	cr.checked = now
+	modified, err := cr.modTime()
+	if err == nil && !modified.Equal(cr.modified) {
+		_ = cr.load()
+	}
+	return cr.cert, nil
+}
+
+// StartTLS : initialize and start the https server, the certificate and key files are reloaded when they change
+func (app *Server) StartTLS(address string, certFile string, keyFile string) {
+	app.TLSCertFile = certFile
+	app.TLSKeyFile = keyFile
+	app.Start(address)
+}
+
+// tlsConfig of the server, nil when the certificate files are not defined
+func (app *Server) tlsConfig() (*tls.Config, error) {
+	if app.TLSCertFile == "" && app.TLSKeyFile == "" {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if app.TLSConfig != nil {
+		config = app.TLSConfig.Clone()
+	}
+	reloader := &certReloader{
+		certFile: app.TLSCertFile,
+		keyFile:  app.TLSKeyFile,
+		checked:  time.Now(),
+	}
+	err := reloader.load()
+	if err != nil {
+		return nil, err
+	}
+	config.Certificates = nil
+	config.GetCertificate = reloader.GetCertificate
+
+	if app.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(app.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errClientCAs
+		}
+		config.ClientCAs = pool
+		if config.ClientAuth == tls.NoClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	return config, nil
+}
+
+// ClientCertificate verified client certificate of a request, nil without mTLS
+func ClientCertificate(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
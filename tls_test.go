@@ -0,0 +1,196 @@
+package katamari
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "katamari test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue a certificate signed by the ca, returns the cert and key pem
+func (ca testCA) issue(t *testing.T, commonName string, serial int64, usage x509.ExtKeyUsage) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})
+}
+
+func (ca testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func writeServerCert(t *testing.T, ca testCA, dir string, serial int64) (string, string) {
+	certPEM, keyPEM := ca.issue(t, "localhost", serial, x509.ExtKeyUsageServerAuth)
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	require.NoError(t, os.WriteFile(certFile, certPEM, 0600))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	return certFile, keyFile
+}
+
+func TestStartTLS(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := writeServerCert(t, ca, dir, 2)
+
+	app := Server{}
+	app.Silence = true
+	app.StartTLS("localhost:0", certFile, keyFile)
+	defer app.Close(os.Interrupt)
+
+	serial := func() int64 {
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: ca.pool()},
+			DisableKeepAlives: true,
+		}}
+		resp, err := client.Get("https://" + app.Address + "/")
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+	require.Equal(t, int64(2), serial())
+
+	// plain http is answered with a 400 by the tls server
+	resp, err := http.Get("http://" + app.Address + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	// replaced certificates are served without a restart
+	time.Sleep(10 * time.Millisecond)
+	writeServerCert(t, ca, dir, 3)
+	require.Eventually(t, func() bool {
+		return serial() == 3
+	}, 3*time.Second, 100*time.Millisecond)
+}
+
+func TestStartTLSClientCertificate(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := writeServerCert(t, ca, dir, 2)
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, ca.pem, 0600))
+	clientPEM, clientKeyPEM := ca.issue(t, "ana", 4, x509.ExtKeyUsageClientAuth)
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	require.NoError(t, err)
+
+	identities := make(chan interface{}, 2)
+	app := Server{}
+	app.Silence = true
+	app.TLSClientCAFile = caFile
+	app.Audit = func(r *http.Request) bool {
+		cert := ClientCertificate(r)
+		return cert != nil && cert.Subject.CommonName == "ana"
+	}
+	app.OnSubscribeCtx = func(ctx context.Context, key string) error {
+		identities <- Identity(ctx)
+		return nil
+	}
+	app.StartTLS("localhost:0", certFile, keyFile)
+	defer app.Close(os.Interrupt)
+
+	config := &tls.Config{RootCAs: ca.pool(), Certificates: []tls.Certificate{clientCert}}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := client.Get("https://" + app.Address + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: ca.pool()}}}
+	resp, err = anonymous.Get("https://" + app.Address + "/")
+	if err == nil {
+		resp.Body.Close()
+	}
+	require.Error(t, err)
+
+	u := url.URL{Scheme: "wss", Host: app.Address, Path: "/things/*"}
+	dialer := websocket.Dialer{TLSClientConfig: config}
+	c, _, err := dialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, "ana", <-identities)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+}
+
+func TestStartTLSInvalidCA(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := writeServerCert(t, ca, dir, 2)
+	caFile := filepath.Join(dir, "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, []byte("not a certificate"), 0600))
+
+	app := Server{TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientCAFile: caFile}
+	_, err := app.tlsConfig()
+	require.ErrorIs(t, err, errClientCAs)
+
+	app = Server{TLSCertFile: certFile, TLSKeyFile: filepath.Join(dir, "missing.key")}
+	_, err = app.tlsConfig()
+	require.Error(t, err)
+
+	app = Server{}
+	config, err := app.tlsConfig()
+	require.NoError(t, err)
+	require.Nil(t, config)
+}
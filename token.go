@@ -0,0 +1,309 @@
+package katamari
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"maps"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/benitogf/katamari/objects"
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
+)
+
+// TokenPath route of the token issuing endpoint
+const TokenPath = "/_token"
+
+// DefaultTokenExpiry lifetime of the issued tokens when TokenAuth doesn't define one
+const DefaultTokenExpiry = 24 * time.Hour
+
+var (
+	errMissingToken  = withCode(ErrUnauthorized, errors.New("katamari: tokenError missing token"))
+	errInvalidToken  = withCode(ErrUnauthorized, errors.New("katamari: tokenError invalid token"))
+	errExpiredToken  = withCode(ErrUnauthorized, errors.New("katamari: tokenError expired token"))
+	errTokenIssuer   = withCode(ErrUnauthorized, errors.New("katamari: tokenError issuer doesn't match"))
+	errTokenAudience = withCode(ErrUnauthorized, errors.New("katamari: tokenError audience doesn't match"))
+	errNoSecret      = errors.New("katamari: tokenError secret is not defined")
+)
+
+// tokenHeader every token is a HS256 JWT
+var tokenHeader = base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+
+// Claims of a token
+type Claims map[string]interface{}
+
+// Subject of the token, the "sub" claim
+func (c Claims) Subject() string {
+	subject, _ := c["sub"].(string)
+	return subject
+}
+
+// Roles of the token, the "roles" claim
+func (c Claims) Roles() []string {
+	switch roles := c["roles"].(type) {
+	case []string:
+		return roles
+	case []interface{}:
+		result := []string{}
+		for _, role := range roles {
+			if name, ok := role.(string); ok {
+				result = append(result, name)
+			}
+		}
+		return result
+	case string:
+		return []string{roles}
+	}
+	return []string{}
+}
+
+// ExpiresAt time of the "exp" claim, zero if the token doesn't define one
+func (c Claims) ExpiresAt() time.Time {
+	exp, ok := c.numeric("exp")
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(exp, 0)
+}
+
+// numeric claim, json decodes numbers as float64
+func (c Claims) numeric(name string) (int64, bool) {
+	switch value := c[name].(type) {
+	case float64:
+		return int64(value), true
+	case int64:
+		return value, true
+	case int:
+		return int64(value), true
+	case json.Number:
+		n, err := value.Int64()
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// audience claim can be a string or a list of strings
+func (c Claims) audience(audience string) bool {
+	switch value := c["aud"].(type) {
+	case string:
+		return value == audience
+	case []interface{}:
+		for _, item := range value {
+			if item == audience {
+				return true
+			}
+		}
+	case []string:
+		for _, item := range value {
+			if item == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// TokenAuth HMAC signed token (HS256 JWT) authentication of the requests
+//
+// Secret: key used to sign and verify the tokens
+//
+// Expiry: lifetime of the issued tokens, defaults to 24 hours
+//
+// Issuer: when defined it's set as the "iss" claim of issued tokens and required on verification
+//
+// Audience: when defined it's set as the "aud" claim of issued tokens and required on verification
+//
+// Validate: optional check of the claims of a verified token, an error denies the request
+//
+// Check: credential check of the issuing endpoint, returns the claims of the token to issue,
+// the endpoint is only available when defined
+//
+// Optional: requests without a token are allowed without claims, invalid tokens are still denied
+type TokenAuth struct {
+	Secret   []byte
+	Expiry   time.Duration
+	Issuer   string
+	Audience string
+	Validate func(claims Claims) error
+	Check    func(r *http.Request) (Claims, error)
+	Optional bool
+}
+
+// TokenResponse of the issuing endpoint
+type TokenResponse struct {
+	Token   string `json:"token"`
+	Expires int64  `json:"expires"`
+}
+
+func (auth *TokenAuth) signature(payload string) string {
+	mac := hmac.New(sha256.New, auth.Secret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Sign a token with the claims, "iat" and "exp" are set if the claims don't define them
+func (auth *TokenAuth) Sign(claims Claims) (string, error) {
+	if len(auth.Secret) == 0 {
+		return "", errNoSecret
+	}
+	now := time.Now()
+	expiry := auth.Expiry
+	if expiry == 0 {
+		expiry = DefaultTokenExpiry
+	}
+	signed := Claims{
+		"iat": now.Unix(),
+		"exp": now.Add(expiry).Unix(),
+	}
+	if auth.Issuer != "" {
+		signed["iss"] = auth.Issuer
+	}
+	if auth.Audience != "" {
+		signed["aud"] = auth.Audience
+	}
+	maps.Copy(signed, claims)
+
+	body, err := json.Marshal(signed)
+	if err != nil {
+		return "", err
+	}
+	payload := tokenHeader + "." + base64.RawURLEncoding.EncodeToString(body)
+	return payload + "." + auth.signature(payload), nil
+}
+
+// Verify the signature, expiry and claims of a token
+func (auth *TokenAuth) Verify(token string) (Claims, error) {
+	if len(auth.Secret) == 0 {
+		return nil, errNoSecret
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || parts[0] != tokenHeader {
+		return nil, errInvalidToken
+	}
+	expected := auth.signature(parts[0] + "." + parts[1])
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return nil, errInvalidToken
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var claims Claims
+	err = json.Unmarshal(body, &claims)
+	if err != nil || claims == nil {
+		return nil, errInvalidToken
+	}
+
+	now := time.Now().Unix()
+	exp, ok := claims.numeric("exp")
+	if !ok {
+		return nil, errInvalidToken
+	}
+	if now >= exp {
+		return nil, errExpiredToken
+	}
+	nbf, ok := claims.numeric("nbf")
+	if ok && now < nbf {
+		return nil, errInvalidToken
+	}
+	if auth.Issuer != "" && claims["iss"] != auth.Issuer {
+		return nil, errTokenIssuer
+	}
+	if auth.Audience != "" && !claims.audience(auth.Audience) {
+		return nil, errTokenAudience
+	}
+	if auth.Validate != nil {
+		err = auth.Validate(claims)
+		if err != nil {
+			return nil, withCode(ErrUnauthorized, err)
+		}
+	}
+	return claims, nil
+}
+
+// requestToken from the Authorization header or the websocket subprotocols ("bearer", token)
+func requestToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "bearer ") {
+		return strings.TrimSpace(authorization[7:])
+	}
+	protocols := websocket.Subprotocols(r)
+	if len(protocols) > 1 && protocols[0] == "bearer" {
+		return protocols[1]
+	}
+	return ""
+}
+
+type claimsKey struct{}
+
+// WithClaims stores the claims of a token in a context
+func WithClaims(ctx context.Context, claims Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, claims)
+}
+
+// TokenClaims of the verified token stored in a context, nil if there is none
+func TokenClaims(ctx context.Context) Claims {
+	if ctx == nil {
+		return nil
+	}
+	claims, _ := ctx.Value(claimsKey{}).(Claims)
+	return claims
+}
+
+// authenticate the token of a request, the returned request carries the claims in its context
+func (app *Server) authenticate(r *http.Request) (*http.Request, error) {
+	if app.Auth == nil {
+		return r, nil
+	}
+	token := requestToken(r)
+	if token == "" {
+		if app.Auth.Optional {
+			return r, nil
+		}
+		return r, errMissingToken
+	}
+	claims, err := app.Auth.Verify(token)
+	if err != nil {
+		return r, err
+	}
+	return r.WithContext(WithClaims(r.Context(), claims)), nil
+}
+
+func (app *Server) issueToken(w http.ResponseWriter, r *http.Request) {
+	if !limitBody(w, r, "", app.MaxBodySize) {
+		return
+	}
+	claims, err := app.Auth.Check(r)
+	if err != nil {
+		app.Console.Err("katamari: token denied", err)
+		writeError(w, "", withCode(ErrUnauthorized, err))
+		return
+	}
+	token, err := app.Auth.Sign(claims)
+	if err != nil {
+		writeError(w, "", withCode(ErrInternal, err))
+		return
+	}
+	verified, err := app.Auth.Verify(token)
+	if err != nil {
+		writeError(w, "", err)
+		return
+	}
+
+	response, err := objects.Encode(TokenResponse{
+		Token:   token,
+		Expires: verified.ExpiresAt().Unix(),
+	})
+	if err != nil {
+		writeError(w, "", withCode(ErrInternal, err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(response)
+}
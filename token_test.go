@@ -0,0 +1,189 @@
+package katamari
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/goccy/go-json"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokenSignVerify(t *testing.T) {
+	t.Parallel()
+	auth := &TokenAuth{Secret: []byte("secret"), Issuer: "katamari", Audience: "tests"}
+	token, err := auth.Sign(Claims{"sub": "ana", "roles": []string{"admin"}})
+	require.NoError(t, err)
+
+	claims, err := auth.Verify(token)
+	require.NoError(t, err)
+	require.Equal(t, "ana", claims.Subject())
+	require.Equal(t, []string{"admin"}, claims.Roles())
+	require.WithinDuration(t, time.Now().Add(DefaultTokenExpiry), claims.ExpiresAt(), 2*time.Second)
+
+	_, err = (&TokenAuth{Secret: []byte("other")}).Verify(token)
+	require.ErrorIs(t, err, ErrUnauthorized)
+
+	parts := strings.Split(token, ".")
+	_, err = auth.Verify(parts[0] + "." + parts[1] + "x." + parts[2])
+	require.ErrorIs(t, err, ErrUnauthorized)
+	_, err = auth.Verify("none")
+	require.ErrorIs(t, err, ErrUnauthorized)
+
+	expired, err := auth.Sign(Claims{"sub": "ana", "exp": time.Now().Add(-time.Minute).Unix()})
+	require.NoError(t, err)
+	_, err = auth.Verify(expired)
+	require.ErrorIs(t, err, errExpiredToken)
+
+	_, err = (&TokenAuth{Secret: []byte("secret"), Issuer: "other"}).Verify(token)
+	require.ErrorIs(t, err, errTokenIssuer)
+	_, err = (&TokenAuth{Secret: []byte("secret"), Audience: "other"}).Verify(token)
+	require.ErrorIs(t, err, errTokenAudience)
+
+	validating := &TokenAuth{Secret: []byte("secret"), Validate: func(claims Claims) error {
+		if claims.Subject() != "ben" {
+			return errors.New("only ben")
+		}
+		return nil
+	}}
+	_, err = validating.Verify(token)
+	require.ErrorIs(t, err, ErrUnauthorized)
+
+	_, err = (&TokenAuth{}).Sign(Claims{})
+	require.Error(t, err)
+}
+
+func TestTokenAuth(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Auth = &TokenAuth{Secret: []byte("secret")}
+	subjects := make(chan string, 2)
+	app.WriteFilterCtx("things/*", func(ctx context.Context, key string, data []byte) ([]byte, error) {
+		subjects <- TokenClaims(ctx).Subject()
+		return data, nil
+	})
+	app.OnSubscribeCtx = func(ctx context.Context, key string) error {
+		subjects <- Identity(ctx).(Claims).Subject()
+		return nil
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	token, err := app.Auth.Sign(Claims{"sub": "ana"})
+	require.NoError(t, err)
+
+	body := []byte(`{"data":"` + messages.Encode([]byte(`{"name":"one"}`)) + `"}`)
+	req := httptest.NewRequest("POST", "/things/1", bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	req = httptest.NewRequest("POST", "/things/1", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer invalid")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	req = httptest.NewRequest("POST", "/things/1", bytes.NewBuffer(body))
+	req.Header.Set("Authorization", "Bearer "+token)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	require.Equal(t, "ana", <-subjects)
+
+	u := url.URL{Scheme: "ws", Host: app.Address, Path: "/things/*"}
+	_, resp, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.Error(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	dialer := websocket.Dialer{Subprotocols: []string{"bearer", token}}
+	c, resp, err := dialer.Dial(u.String(), nil)
+	require.NoError(t, err)
+	defer c.Close()
+	require.Equal(t, "bearer", resp.Header.Get("Sec-WebSocket-Protocol"))
+	require.Equal(t, "ana", <-subjects)
+	c.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = c.ReadMessage()
+	require.NoError(t, err)
+}
+
+func TestTokenAuthOptional(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Auth = &TokenAuth{Secret: []byte("secret"), Optional: true}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req := httptest.NewRequest("GET", "/things/*", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+
+	req = httptest.NewRequest("GET", "/things/*", nil)
+	req.Header.Set("Authorization", "Bearer invalid")
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+}
+
+func TestTokenIssue(t *testing.T) {
+	t.Parallel()
+	app := Server{}
+	app.Silence = true
+	app.Auth = &TokenAuth{
+		Secret: []byte("secret"),
+		Expiry: time.Hour,
+		Check: func(r *http.Request) (Claims, error) {
+			var credentials struct {
+				Account  string `json:"account"`
+				Password string `json:"password"`
+			}
+			err := json.NewDecoder(r.Body).Decode(&credentials)
+			if err != nil || credentials.Account != "ana" || credentials.Password != "123" {
+				return nil, errors.New("invalid credentials")
+			}
+			return Claims{"sub": credentials.Account, "roles": []string{"writer"}}, nil
+		},
+	}
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	req := httptest.NewRequest("POST", TokenPath, bytes.NewBufferString(`{"account":"ana","password":"000"}`))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Result().StatusCode)
+
+	req = httptest.NewRequest("POST", TokenPath, bytes.NewBufferString(`{"account":"ana","password":"123"}`))
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	resp := w.Result()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	var issued TokenResponse
+	err = json.Unmarshal(body, &issued)
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Add(time.Hour).Unix(), issued.Expires, 2)
+
+	claims, err := app.Auth.Verify(issued.Token)
+	require.NoError(t, err)
+	require.Equal(t, []string{"writer"}, claims.Roles())
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+issued.Token)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
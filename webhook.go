@@ -0,0 +1,452 @@
+package katamari
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/benitogf/katamari/key"
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/goccy/go-json"
+)
+
+const (
+	// WebhookPath reserved prefix of the webhook queue and dead letters, not reachable through the api
+	WebhookPath = "_webhooks"
+	// WebhookSignatureHeader hex HMAC-SHA256 of the delivery body, signed with the webhook secret
+	WebhookSignatureHeader = "X-Katamari-Signature"
+	// WebhookEventHeader id of the delivered event
+	WebhookEventHeader = "X-Katamari-Event"
+	// DefaultWebhookAttempts deliveries of an event before it is moved to the dead letters
+	DefaultWebhookAttempts = 5
+	// DefaultWebhookBackoff wait before the first retry, it doubles on every attempt
+	DefaultWebhookBackoff = time.Second
+	// DefaultWebhookTimeout longest wait for the response of a delivery
+	DefaultWebhookTimeout = 10 * time.Second
+)
+
+const (
+	webhookQueue = WebhookPath + "/queue"
+	webhookDead  = WebhookPath + "/dead"
+	// webhookIdle wait of the dispatcher when nothing is queued
+	webhookIdle = time.Minute
+)
+
+var errWebhookRemoved = errors.New("katamari: webhookError the webhook is no longer registered")
+
+// WebhookEvent payload of a webhook delivery
+//
+// Data: the stored json, empty on deletes
+//
+// Version: updated time of the stored object (the created time of a new one) in nanoseconds, empty on deletes
+//
+// Time: time of the change in nanoseconds
+type WebhookEvent struct {
+	ID        string          `json:"id"`
+	Key       string          `json:"key"`
+	Operation string          `json:"operation"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Version   int64           `json:"version,omitempty"`
+	Time      int64           `json:"time"`
+}
+
+// WebhookDelivery queued or dead delivery of an event
+//
+// Next: time of the next attempt in nanoseconds
+//
+// Error: reason of the last failed attempt
+type WebhookDelivery struct {
+	ID       string       `json:"id"`
+	Path     string       `json:"path"`
+	URL      string       `json:"url"`
+	Event    WebhookEvent `json:"event"`
+	Attempts int          `json:"attempts"`
+	Next     int64        `json:"next"`
+	Error    string       `json:"error,omitempty"`
+}
+
+// webhook target of the changes of a path
+type webhook struct {
+	path   string
+	url    string
+	secret []byte
+}
+
+// webhooks registered targets and state of the dispatcher
+//
+// serving: the server runs and the dispatcher can be started
+//
+// dispatching: the dispatcher is running
+type webhooks struct {
+	mutex       sync.RWMutex
+	hooks       []webhook
+	wake        chan struct{}
+	done        chan struct{}
+	stopped     sync.WaitGroup
+	serving     bool
+	dispatching bool
+}
+
+// Webhook sends the changes made through the api on a path (glob) to a url,
+// the body is signed with the secret on the WebhookSignatureHeader.
+// Webhooks can be registered before or after the server starts
+func (app *Server) Webhook(path string, url string, secret string) {
+	app.webhooks.mutex.Lock()
+	defer app.webhooks.mutex.Unlock()
+	app.webhooks.hooks = append(app.webhooks.hooks, webhook{
+		path:   path,
+		url:    url,
+		secret: []byte(secret),
+	})
+	app.dispatch()
+}
+
+// serveWebhooks allows the dispatcher to run, it starts once there is a webhook
+func (app *Server) serveWebhooks() {
+	app.webhooks.mutex.Lock()
+	defer app.webhooks.mutex.Unlock()
+	app.webhooks.serving = true
+	app.dispatch()
+}
+
+// stopWebhooks stops the dispatcher and waits for it or the end of the context
+func (app *Server) stopWebhooks(ctx context.Context) error {
+	app.webhooks.mutex.Lock()
+	serving := app.webhooks.serving
+	app.webhooks.serving = false
+	app.webhooks.dispatching = false
+	app.webhooks.mutex.Unlock()
+	if !serving {
+		return nil
+	}
+	close(app.webhooks.done)
+	return waitGroup(ctx, &app.webhooks.stopped)
+}
+
+// dispatch starts the dispatcher if the server runs and a webhook is registered, the webhooks mutex should be held
+func (app *Server) dispatch() {
+	if !app.webhooks.serving || app.webhooks.dispatching || len(app.webhooks.hooks) == 0 {
+		return
+	}
+	app.webhooks.dispatching = true
+	app.webhooks.stopped.Add(1)
+	go app.dispatchWebhooks()
+}
+
+// find the registered webhook of a delivery
+func (wh *webhooks) find(path string, url string) (webhook, bool) {
+	wh.mutex.RLock()
+	defer wh.mutex.RUnlock()
+	for _, hook := range wh.hooks {
+		if hook.path == path && hook.url == url {
+			return hook, true
+		}
+	}
+	return webhook{}, false
+}
+
+func (wh *webhooks) active() bool {
+	wh.mutex.RLock()
+	defer wh.mutex.RUnlock()
+	return len(wh.hooks) > 0
+}
+
+// signal the dispatcher that a delivery is queued
+func (wh *webhooks) signal() {
+	select {
+	case wh.wake <- struct{}{}:
+	default:
+	}
+}
+
+// webhookSignature of a delivery body
+func webhookSignature(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// storedVersion of a key for the webhook events, read while the key is locked so it belongs to the write,
+// zero without webhooks
+func (app *Server) storedVersion(_key string) int64 {
+	if !app.webhooks.active() {
+		return 0
+	}
+	raw, err := app.Storage.Get(_key)
+	if err != nil {
+		return 0
+	}
+	obj, err := objects.DecodeRaw(raw)
+	if err != nil {
+		return 0
+	}
+	return max(obj.Created, obj.Updated)
+}
+
+// webhookData embeds the stored data as json, values that aren't valid json are embedded as strings
+func webhookData(data string) json.RawMessage {
+	if data == "" {
+		return nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil
+	}
+	if json.Valid(decoded) {
+		return decoded
+	}
+	encoded, _ := json.Marshal(string(decoded))
+	return encoded
+}
+
+// queueWebhooks stores a delivery of the change for every webhook of the key
+func (app *Server) queueWebhooks(c *change) {
+	if !app.webhooks.active() {
+		return
+	}
+	app.webhooks.mutex.RLock()
+	hooks := []webhook{}
+	for _, hook := range app.webhooks.hooks {
+		if hook.path == c.key || key.Match(hook.path, c.key) {
+			hooks = append(hooks, hook)
+		}
+	}
+	app.webhooks.mutex.RUnlock()
+	if len(hooks) == 0 {
+		return
+	}
+
+	event := WebhookEvent{
+		ID:        app.uniqueIndex(c.timestamp),
+		Key:       c.key,
+		Operation: c.operation,
+		Data:      webhookData(c.after),
+		Version:   c.version,
+		Time:      c.timestamp,
+	}
+	for _, hook := range hooks {
+		delivery := WebhookDelivery{
+			ID:    app.uniqueIndex(c.timestamp),
+			Path:  hook.path,
+			URL:   hook.url,
+			Event: event,
+		}
+		err := app.storeDelivery(webhookQueue, delivery)
+		if err != nil {
+			app.Console.Err("webhookError["+c.key+"]", err)
+		}
+	}
+	app.webhooks.signal()
+}
+
+func (app *Server) storeDelivery(path string, delivery WebhookDelivery) error {
+	data, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	_, err = app.Storage.Set(path+"/"+delivery.ID, messages.Encode(data))
+	return err
+}
+
+// deliveries stored under a path, oldest first
+func (app *Server) deliveries(path string) ([]WebhookDelivery, error) {
+	raw, err := app.Storage.Get(path + "/*")
+	if err != nil {
+		if isNotFound(err) {
+			return []WebhookDelivery{}, nil
+		}
+		return nil, err
+	}
+	list, err := objects.DecodeList(raw)
+	if err != nil {
+		return nil, err
+	}
+	result := []WebhookDelivery{}
+	for _, obj := range list {
+		var delivery WebhookDelivery
+		err = json.Unmarshal([]byte(obj.Data), &delivery)
+		if err != nil {
+			continue
+		}
+		result = append(result, delivery)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return len(result[i].ID) < len(result[j].ID) ||
+			(len(result[i].ID) == len(result[j].ID) && result[i].ID < result[j].ID)
+	})
+	return result, nil
+}
+
+// DeadLetters webhook deliveries that ran out of attempts
+func (app *Server) DeadLetters() ([]WebhookDelivery, error) {
+	return app.deliveries(webhookDead)
+}
+
+// Redeliver queues again a dead letter
+func (app *Server) Redeliver(id string) error {
+	raw, err := app.Storage.Get(webhookDead + "/" + id)
+	if err != nil {
+		return err
+	}
+	obj, err := objects.Decode(raw)
+	if err != nil {
+		return err
+	}
+	var delivery WebhookDelivery
+	err = json.Unmarshal([]byte(obj.Data), &delivery)
+	if err != nil {
+		return err
+	}
+	delivery.Attempts = 0
+	delivery.Next = 0
+	delivery.Error = ""
+	err = app.storeDelivery(webhookQueue, delivery)
+	if err != nil {
+		return err
+	}
+	err = app.Storage.Del(webhookDead + "/" + id)
+	app.webhooks.signal()
+	return err
+}
+
+// deliver posts the event of a delivery to its webhook
+func (app *Server) deliver(ctx context.Context, delivery WebhookDelivery) error {
+	hook, found := app.webhooks.find(delivery.Path, delivery.URL)
+	if !found {
+		return errWebhookRemoved
+	}
+	body, err := json.Marshal(delivery.Event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, delivery.Event.ID)
+	req.Header.Set(WebhookSignatureHeader, webhookSignature(hook.secret, body))
+	resp, err := app.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("katamari: webhookError response status " + strconv.Itoa(resp.StatusCode))
+	}
+	return nil
+}
+
+// flushWebhooks attempts the due deliveries, returns the wait until the next one.
+// Each endpoint gets its own worker so a slow endpoint doesn't hold the deliveries of the others
+func (app *Server) flushWebhooks(ctx context.Context, now time.Time) time.Duration {
+	queue, err := app.deliveries(webhookQueue)
+	if err != nil {
+		app.Console.Err("webhookError", err)
+		return app.WebhookBackoff
+	}
+
+	wait := webhookIdle
+	urls := []string{}
+	due := map[string][]WebhookDelivery{}
+	for _, delivery := range queue {
+		if delivery.Next > now.UnixNano() {
+			wait = min(wait, time.Duration(delivery.Next-now.UnixNano()))
+			continue
+		}
+		if _, found := due[delivery.URL]; !found {
+			urls = append(urls, delivery.URL)
+		}
+		due[delivery.URL] = append(due[delivery.URL], delivery)
+	}
+
+	var mutex sync.Mutex
+	var workers sync.WaitGroup
+	for _, url := range urls {
+		workers.Add(1)
+		go func(deliveries []WebhookDelivery) {
+			defer workers.Done()
+			for _, delivery := range deliveries {
+				if ctx.Err() != nil {
+					return
+				}
+				retry := app.attemptDelivery(ctx, delivery)
+				mutex.Lock()
+				wait = min(wait, retry)
+				mutex.Unlock()
+			}
+		}(due[url])
+	}
+	workers.Wait()
+	return wait
+}
+
+// attemptDelivery posts a due delivery, returns the wait until its retry
+func (app *Server) attemptDelivery(ctx context.Context, delivery WebhookDelivery) time.Duration {
+	deliverCtx, cancel := context.WithTimeout(ctx, app.WebhookTimeout)
+	err := app.deliver(deliverCtx, delivery)
+	cancel()
+	if err == nil {
+		_ = app.Storage.Del(webhookQueue + "/" + delivery.ID)
+		return webhookIdle
+	}
+	// closing, the attempt is not counted
+	if ctx.Err() != nil {
+		return webhookIdle
+	}
+
+	delivery.Attempts++
+	delivery.Error = err.Error()
+	app.Console.Err("webhookError["+delivery.Event.Key+"]", err)
+	if delivery.Attempts >= app.WebhookAttempts || errors.Is(err, errWebhookRemoved) {
+		err = app.storeDelivery(webhookDead, delivery)
+		if err == nil {
+			_ = app.Storage.Del(webhookQueue + "/" + delivery.ID)
+		}
+		return webhookIdle
+	}
+	backoff := app.WebhookBackoff << (delivery.Attempts - 1)
+	delivery.Next = time.Now().Add(backoff).UnixNano()
+	err = app.storeDelivery(webhookQueue, delivery)
+	if err != nil {
+		app.Console.Err("webhookError["+delivery.Event.Key+"]", err)
+	}
+	return backoff
+}
+
+// dispatchWebhooks delivers the queued events until the server closes,
+// the queue is read from the storage so pending deliveries survive restarts
+func (app *Server) dispatchWebhooks() {
+	defer app.webhooks.stopped.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-app.webhooks.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-app.webhooks.wake:
+		case <-timer.C:
+		}
+		timer.Reset(app.flushWebhooks(ctx, time.Now()))
+	}
+}
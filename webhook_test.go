@@ -0,0 +1,269 @@
+package katamari
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/benitogf/katamari/messages"
+	"github.com/benitogf/katamari/objects"
+	"github.com/goccy/go-json"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookTarget records the deliveries it accepts, responds with the status of fail while it's set
+type webhookTarget struct {
+	mutex    sync.Mutex
+	events   []WebhookEvent
+	received chan WebhookEvent
+	attempts int64
+	fail     int64
+}
+
+func newWebhookTarget(t *testing.T, secret string) (*webhookTarget, *httptest.Server) {
+	target := &webhookTarget{received: make(chan WebhookEvent, 10)}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&target.attempts, 1)
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		if r.Header.Get(WebhookSignatureHeader) != webhookSignature([]byte(secret), body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if status := atomic.LoadInt64(&target.fail); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+		var event WebhookEvent
+		err = json.Unmarshal(body, &event)
+		require.NoError(t, err)
+		require.Equal(t, event.ID, r.Header.Get(WebhookEventHeader))
+		target.received <- event
+	}))
+	return target, server
+}
+
+func webhookPublish(t *testing.T, app *Server, path string, data string) {
+	body := []byte(`{"data":"` + messages.Encode([]byte(data)) + `"}`)
+	req := httptest.NewRequest("POST", path, bytes.NewBuffer(body))
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+}
+
+func receiveEvent(t *testing.T, target *webhookTarget) WebhookEvent {
+	select {
+	case event := <-target.received:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+	return WebhookEvent{}
+}
+
+func TestWebhook(t *testing.T) {
+	t.Parallel()
+	target, server := newWebhookTarget(t, "secret")
+	defer server.Close()
+	wrongSecret, wrongServer := newWebhookTarget(t, "other")
+	defer wrongServer.Close()
+
+	app := Server{}
+	app.Silence = true
+	app.WebhookBackoff = 10 * time.Millisecond
+	app.WebhookAttempts = 2
+	app.Webhook("things/*", server.URL, "secret")
+	app.Webhook("things/*", wrongServer.URL, "secret")
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	webhookPublish(t, &app, "/things/1", `{"name":"one"}`)
+	webhookPublish(t, &app, "/other/1", `{"name":"other"}`)
+	event := receiveEvent(t, target)
+	require.Equal(t, "things/1", event.Key)
+	require.Equal(t, OpWrite, event.Operation)
+	require.JSONEq(t, `{"name":"one"}`, string(event.Data))
+	require.NotZero(t, event.Time)
+	raw, err := app.Storage.Get("things/1")
+	require.NoError(t, err)
+	stored, err := objects.DecodeRaw(raw)
+	require.NoError(t, err)
+	require.Equal(t, stored.Created, event.Version)
+
+	req := httptest.NewRequest("DELETE", "/things/1", nil)
+	w := httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusNoContent, w.Result().StatusCode)
+	event = receiveEvent(t, target)
+	require.Equal(t, "things/1", event.Key)
+	require.Equal(t, OpDelete, event.Operation)
+	require.Empty(t, event.Data)
+	require.Zero(t, event.Version)
+
+	// the target that rejects the signature ends in the dead letters
+	require.Eventually(t, func() bool {
+		dead, err := app.DeadLetters()
+		require.NoError(t, err)
+		return len(dead) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Empty(t, wrongSecret.received)
+
+	// the deliveries can't be read through a glob
+	req = httptest.NewRequest("GET", "/*/*/*", nil)
+	w = httptest.NewRecorder()
+	app.Router.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Result().StatusCode)
+	listed, err := objects.DecodeList(w.Body.Bytes())
+	require.NoError(t, err)
+	require.Empty(t, listed)
+
+	dead, err := app.DeadLetters()
+	require.NoError(t, err)
+	require.Equal(t, 2, dead[0].Attempts)
+	require.Equal(t, wrongServer.URL, dead[0].URL)
+	require.Equal(t, OpWrite, dead[0].Event.Operation)
+	require.Equal(t, OpDelete, dead[1].Event.Operation)
+	require.Contains(t, dead[0].Error, "401")
+	require.Empty(t, target.received)
+}
+
+func TestWebhookRetry(t *testing.T) {
+	t.Parallel()
+	target, server := newWebhookTarget(t, "secret")
+	defer server.Close()
+	atomic.StoreInt64(&target.fail, http.StatusServiceUnavailable)
+
+	app := Server{}
+	app.Silence = true
+	app.WebhookBackoff = 20 * time.Millisecond
+	app.WebhookAttempts = 3
+	app.Webhook("things/*", server.URL, "secret")
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	webhookPublish(t, &app, "/things/1", `{"name":"one"}`)
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&target.attempts) == 2
+	}, 2*time.Second, 5*time.Millisecond)
+	atomic.StoreInt64(&target.fail, 0)
+	event := receiveEvent(t, target)
+	require.Equal(t, "things/1", event.Key)
+	require.Equal(t, int64(3), atomic.LoadInt64(&target.attempts))
+
+	// the dead letters can be delivered again
+	atomic.StoreInt64(&target.fail, http.StatusInternalServerError)
+	webhookPublish(t, &app, "/things/2", `{"name":"two"}`)
+	var dead []WebhookDelivery
+	require.Eventually(t, func() bool {
+		var err error
+		dead, err = app.DeadLetters()
+		require.NoError(t, err)
+		return len(dead) == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	require.Equal(t, 3, dead[0].Attempts)
+
+	atomic.StoreInt64(&target.fail, 0)
+	err := app.Redeliver(dead[0].ID)
+	require.NoError(t, err)
+	event = receiveEvent(t, target)
+	require.Equal(t, "things/2", event.Key)
+	dead, err = app.DeadLetters()
+	require.NoError(t, err)
+	require.Empty(t, dead)
+	require.ErrorIs(t, app.Redeliver("missing"), ErrNotFound)
+}
+
+func TestWebhookQueueSurvivesRestart(t *testing.T) {
+	t.Parallel()
+	target, server := newWebhookTarget(t, "secret")
+	defer server.Close()
+	atomic.StoreInt64(&target.fail, http.StatusServiceUnavailable)
+	db := &MemoryStorage{}
+
+	app := Server{}
+	app.Silence = true
+	app.Storage = db
+	app.WebhookBackoff = 200 * time.Millisecond
+	app.Webhook("things/*", server.URL, "secret")
+	app.Start("localhost:0")
+	webhookPublish(t, &app, "/things/1", `{"name":"one"}`)
+	require.Eventually(t, func() bool {
+		queue, err := app.deliveries(webhookQueue)
+		require.NoError(t, err)
+		return len(queue) == 1 && queue[0].Attempts == 1
+	}, 2*time.Second, 5*time.Millisecond)
+	app.Close(os.Interrupt)
+
+	atomic.StoreInt64(&target.fail, 0)
+	restarted := Server{}
+	restarted.Silence = true
+	restarted.Storage = db
+	restarted.Webhook("things/*", server.URL, "secret")
+	restarted.Start("localhost:0")
+	defer restarted.Close(os.Interrupt)
+	event := receiveEvent(t, target)
+	require.Equal(t, "things/1", event.Key)
+}
+
+func TestWebhookAfterStart(t *testing.T) {
+	t.Parallel()
+	target, server := newWebhookTarget(t, "secret")
+	defer server.Close()
+
+	app := Server{}
+	app.Silence = true
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	app.Webhook("things/*", server.URL, "secret")
+	webhookPublish(t, &app, "/things/1", `{"name":"one"}`)
+	event := receiveEvent(t, target)
+	require.Equal(t, "things/1", event.Key)
+}
+
+func TestWebhookSlowEndpoint(t *testing.T) {
+	t.Parallel()
+	target, server := newWebhookTarget(t, "secret")
+	defer server.Close()
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	app := Server{}
+	app.Silence = true
+	app.WebhookTimeout = 200 * time.Millisecond
+	app.WebhookBackoff = time.Minute
+	app.Webhook("things/*", slow.URL, "secret")
+	app.Webhook("things/*", server.URL, "secret")
+	app.Start("localhost:0")
+	defer app.Close(os.Interrupt)
+
+	// the other endpoint is not held by the slow one
+	start := time.Now()
+	webhookPublish(t, &app, "/things/1", `{"name":"one"}`)
+	receiveEvent(t, target)
+	require.Less(t, time.Since(start), app.WebhookTimeout)
+
+	// the slow delivery times out and is retried later
+	require.Eventually(t, func() bool {
+		queue, err := app.deliveries(webhookQueue)
+		require.NoError(t, err)
+		return len(queue) == 1 && queue[0].Attempts == 1
+	}, 2*time.Second, 10*time.Millisecond)
+	queue, err := app.deliveries(webhookQueue)
+	require.NoError(t, err)
+	require.Equal(t, slow.URL, queue[0].URL)
+	require.Contains(t, queue[0].Error, "deadline")
+}
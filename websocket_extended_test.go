@@ -1,6 +1,7 @@
 package katamari
 
 import (
+	"context"
 	"errors"
 	"net/url"
 	"os"
@@ -95,7 +96,7 @@ func TestWebSocketWithVersion(t *testing.T) {
 	// wait for the broadcast of the write to generate a new version
 	time.Sleep(100 * time.Millisecond)
 	// Get current version
-	entry, err := app.fetch("versiontest")
+	entry, err := app.fetch(context.Background(), "versiontest")
 	require.NoError(t, err)
 
 	// log.Println("versiontest", strconv.FormatInt(entry.Version, 16))
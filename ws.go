@@ -5,11 +5,9 @@ import (
 	"strconv"
 
 	"github.com/benitogf/katamari/messages"
-	"github.com/gorilla/mux"
 )
 
-func (app *Server) ws(w http.ResponseWriter, r *http.Request) error {
-	_key := mux.Vars(r)["key"]
+func (app *Server) ws(w http.ResponseWriter, r *http.Request, _key string) error {
 	version := r.FormValue("v")
 
 	err := app.filters.Read.checkStatic(_key, app.Static)
@@ -18,20 +16,29 @@ func (app *Server) ws(w http.ResponseWriter, r *http.Request) error {
 		return err
 	}
 
-	client, err := app.Stream.New(_key, w, r)
+	open := app.Stream.New
+	fetch := app.fetch
+	encode := messages.Encode
+	if rawAccept(r) {
+		open = app.Stream.NewRaw
+		fetch = app.fetchRaw
+		encode = func(data []byte) string { return string(data) }
+	}
+
+	client, err := open(_key, w, r)
 	if err != nil {
 		return err
 	}
 
-	// send initial msg
-	entry, err := app.fetch(_key)
+	// send initial msg, the data of the pool that the client joined
+	entry, err := fetch(app.Stream.PoolContext(client), _key)
 	if err != nil {
 		app.Console.Err("katamari: filtered route", err)
 		return err
 	}
 
 	if version != strconv.FormatInt(entry.Version, 16) {
-		go app.Stream.Write(client, messages.Encode(entry.Data), true, entry.Version)
+		go app.Stream.Write(client, encode(entry.Data), true, entry.Version)
 	}
 	app.Stream.Read(_key, client)
 	return nil